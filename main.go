@@ -1,38 +1,251 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/smtp"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	texttemplate "text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/antonholmquist/jason"
 	"github.com/drone/config"
 	"github.com/dustin/randbo"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/sessions"
+	"github.com/pelletier/go-toml"
 	"github.com/unrolled/render"
 	"github.com/zenazn/goji"
 	"github.com/zenazn/goji/web"
 	"github.com/zenazn/goji/web/middleware"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
 	"golang.org/x/oauth2/google"
 	"gopkg.in/boj/redistore.v1"
 )
 
 type Form struct {
-	ID          string
+	ID              string
+	Name            string
+	RedirectURL     string
+	FailureURL      string
+	ThankYou        string
+	IgnoreIP        bool
+	IgnoreUserAgent bool
+	IgnoreReferrer  bool
+	IgnoreUTM       bool
+	Definition      string
+	Theme           string
+	ThemeBackground string
+	ThemeColor      string
+	ThemeAccent     string
+	ThemeFont       string
+	CustomCSS       string
+	Logo            string
+	Language        string
+	Disabled        bool
+	OpensAt         int64
+	ClosesAt        int64
+	MaxEntries      int64
+	ClosedMessage   string
+	UniqueFields    string
+	UniqueAction    string
+	LockFields      bool
+	Team            string
+	Owner           string
+	Unread          int64  `redis:"-"`
+	Role            string `redis:"-"`
+}
+
+type Field struct {
 	Name        string
-	RedirectURL string
+	Label       string
+	Type        string
+	Placeholder string
+	Help        string
+	Options     []string
+	Required    bool
+}
+
+// Rule shows, hides or requires Field when the value of the When field
+// equals Equals.
+type Rule struct {
+	Field  string
+	Action string
+	When   string
+	Equals string
+}
+
+type Definition struct {
+	Fields []Field
+	Rules  []Rule
+}
+
+// Page is a step of a multi-step form. Fields of the "page" type start a new
+// one, titled with their label.
+type Page struct {
+	Title  string
+	Fields []Field
 }
 
 type EntryMeta struct {
+	ID          string
+	Submitted   int64
+	IP          string
+	UserAgent   string
+	Referrer    string
+	Origin      string
+	UTMSource   string
+	UTMMedium   string
+	UTMCampaign string
+	UTMTerm     string
+	UTMContent  string
+}
+
+type Entry struct {
+	EntryMeta
+	Unread  bool
+	Starred bool
+	Labels  []string
+	Fields  map[string]string
+}
+
+// Partial is a response to a multi-step form that hasn't been submitted yet
+type Partial struct {
+	Token   string
+	Page    int
+	Values  url.Values
+	Meta    url.Values
+	Updated int64
+}
+
+// Version is what an entry was before it was replaced by a later
+// submission with the same unique fields.
+type Version struct {
 	ID        string
 	Submitted int64
+	Fields    map[string]string
+}
+
+type Comment struct {
+	ID         string
+	Author     string
+	AuthorName string `redis:"-"`
+	Text       string
+	Created    int64
+}
+
+type Count struct {
+	Value string
+	Count int
+}
+
+type byCount []Count
+
+func (c byCount) Len() int      { return len(c) }
+func (c byCount) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCount) Less(i, j int) bool {
+	if c[i].Count == c[j].Count {
+		return c[i].Value < c[j].Value
+	}
+	return c[i].Count > c[j].Count
+}
+
+type Bucket struct {
+	Start   int64
+	Count   int
+	Percent int
+}
+
+type Stats struct {
+	Period       string
+	Total        int64
+	Current      int
+	Previous     int
+	Trend        int
+	Series       []Bucket
+	TopReferrers []Count
+	Fields       map[string][]Count
+}
+
+// Theme styles a form's hosted pages. Its values end up as CSS variables
+// in the public layout.
+type Theme struct {
+	Name        string
+	Label       string
+	Background  template.CSS
+	Surface     template.CSS
+	Color       template.CSS
+	Border      template.CSS
+	Accent      template.CSS
+	AccentColor template.CSS
+	Font        template.CSS
+	FontURL     string
+	CSS         template.CSS
+}
+
+// Provider is a service people can log in with over OAuth 2.0. User looks
+// up who logged in with the client the login was authorized for.
+type Provider struct {
+	Name         string
+	Label        string
+	ClientID     *string
+	ClientSecret *string
+	Scopes       []string
+	Endpoint     func() (oauth2.Endpoint, error)
+	User         func(cli *http.Client) (User, error)
+}
+
+// User is someone who logged in with a provider. IDs are only unique to
+// their provider.
+type User struct {
+	ID    string
+	Email string
+	Name  string
+}
+
+type Language struct {
+	Code string
+	Name string
+}
+
+// userError is an error people get to see. Its message is looked up in the
+// message catalogs before its arguments are filled in.
+type userError struct {
+	format string
+	args   []interface{}
+}
+
+func (e userError) Error() string {
+	return fmt.Sprintf(e.format, e.args...)
 }
 
 type Message struct {
@@ -49,8 +262,255 @@ var (
 	googleClientID      = config.String("google-client-id", "")
 	googleClientSecret  = config.String("google-client-secret", "")
 	googleAllowedEmails = config.String("google-allowed-emails", "")
+	githubClientID      = config.String("github-client-id", "")
+	githubClientSecret  = config.String("github-client-secret", "")
+	gitlabURL           = config.String("gitlab-url", "https://gitlab.com")
+	gitlabClientID      = config.String("gitlab-client-id", "")
+	gitlabClientSecret  = config.String("gitlab-client-secret", "")
+	oidcIssuer          = config.String("oidc-issuer", "")
+	oidcName            = config.String("oidc-name", "OpenID Connect")
+	oidcClientID        = config.String("oidc-client-id", "")
+	oidcClientSecret    = config.String("oidc-client-secret", "")
+	allowedEmails       = config.String("allowed-emails", "")
+	deniedEmails        = config.String("denied-emails", "")
+	admins              = config.String("admins", "")
+	approveSignups      = config.Bool("approve-signups", false)
+	auditLogSize        = config.Int("audit-log-size", 100000)
+	localAccounts       = config.Bool("local-accounts", false)
+	localSignup         = config.Bool("local-signup", false)
+	baseURL             = config.String("base-url", "")
+	smtpHost            = config.String("smtp-host", "")
+	smtpPort            = config.Int("smtp-port", 587)
+	smtpUsername        = config.String("smtp-username", "")
+	smtpPassword        = config.String("smtp-password", "")
+	smtpFrom            = config.String("smtp-from", "formic@localhost")
+	trustedProxies      = config.String("trusted-proxies", "")
+	redirectDomains     = config.String("redirect-domains", "")
+	maxBodySize         = config.Int64("max-body-size", 1<<20)
+	maxFields           = config.Int("max-fields", 100)
+	maxValueLength      = config.Int("max-value-length", 10000)
+)
+
+// 1x1 transparent GIF served by the view tracker
+var pixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00,
+	0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// Field types hosted forms know how to render
+var fieldTypes = []string{
+	"text",
+	"email",
+	"number",
+	"tel",
+	"url",
+	"date",
+	"textarea",
+	"select",
+	"radio",
+	"checkbox",
+	"page",
+}
+
+// Providers people can log in with, in the order they're offered. Only
+// the ones with a client ID are enabled. Google's user IDs aren't prefixed
+// with its name since it used to be the only one.
+var providers = []*Provider{
+	{
+		Name:         "google",
+		Label:        "Google",
+		ClientID:     googleClientID,
+		ClientSecret: googleClientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+		Endpoint:     staticEndpoint(google.Endpoint),
+		User: func(cli *http.Client) (User, error) {
+			return oidcUser(cli, "https://openidconnect.googleapis.com/v1/userinfo")
+		},
+	},
+	{
+		Name:         "github",
+		Label:        "GitHub",
+		ClientID:     githubClientID,
+		ClientSecret: githubClientSecret,
+		Scopes:       []string{"read:user", "user:email"},
+		Endpoint:     staticEndpoint(github.Endpoint),
+		User:         githubUser,
+	},
+	{
+		Name:         "gitlab",
+		Label:        "GitLab",
+		ClientID:     gitlabClientID,
+		ClientSecret: gitlabClientSecret,
+		Scopes:       []string{"read_user"},
+		Endpoint: func() (oauth2.Endpoint, error) {
+			base := strings.TrimRight(*gitlabURL, "/")
+			return oauth2.Endpoint{
+				AuthURL:  base + "/oauth/authorize",
+				TokenURL: base + "/oauth/token",
+			}, nil
+		},
+		User: gitlabUser,
+	},
+	{
+		Name:         "oidc",
+		Label:        "OpenID Connect",
+		ClientID:     oidcClientID,
+		ClientSecret: oidcClientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+		Endpoint: func() (oauth2.Endpoint, error) {
+			d, err := discoverOIDC()
+			if err != nil {
+				return oauth2.Endpoint{}, err
+			}
+			auth, _ := d.GetString("authorization_endpoint")
+			token, _ := d.GetString("token_endpoint")
+			return oauth2.Endpoint{AuthURL: auth, TokenURL: token}, nil
+		},
+		User: func(cli *http.Client) (User, error) {
+			d, err := discoverOIDC()
+			if err != nil {
+				return User{}, err
+			}
+			userinfo, err := d.GetString("userinfo_endpoint")
+			if err != nil {
+				return User{}, errors.New("OpenID provider doesn't have a userinfo endpoint")
+			}
+			return oidcUser(cli, userinfo)
+		},
+	},
+}
+
+// Languages Formic has been translated to. Their message catalogs are in
+// locales/<code>.json and map English messages to translated ones.
+var languages = []Language{
+	{"en", "English"},
+	{"es", "Español"},
+	{"fr", "Français"},
+}
+
+var catalogs = make(map[string]map[string]string)
+
+// The bits of Markdown thank-you pages can use
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdBullet  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdOrdered = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdToken   = regexp.MustCompile("`([^`]+)`" + `|\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdStrong  = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	mdEm      = regexp.MustCompile(`\*(.+?)\*`)
+)
+
+// Built-in themes for hosted forms. The first one is the default.
+var themes = []Theme{
+	{
+		Name:        "formic",
+		Label:       "Formic",
+		Background:  "black url(/static/images/space.jpg) no-repeat center center / cover",
+		Surface:     "transparent",
+		Color:       "white",
+		Border:      "silver",
+		Accent:      "white",
+		AccentColor: "#333",
+		Font:        "Titillium Web, sans-serif",
+		FontURL:     "//fonts.googleapis.com/css?family=Titillium+Web:300,400,700",
+	},
+	{
+		Name:        "light",
+		Label:       "Light",
+		Background:  "#f4f5f7",
+		Surface:     "white",
+		Color:       "#222",
+		Border:      "#d1d1d1",
+		Accent:      "#1eaedb",
+		AccentColor: "white",
+		Font:        "-apple-system, Helvetica Neue, Helvetica, Arial, sans-serif",
+	},
+	{
+		Name:        "dark",
+		Label:       "Dark",
+		Background:  "#1d1f21",
+		Surface:     "#282a2e",
+		Color:       "#e0e0e0",
+		Border:      "#4b4e55",
+		Accent:      "#81a2be",
+		AccentColor: "#1d1f21",
+		Font:        "-apple-system, Helvetica Neue, Helvetica, Arial, sans-serif",
+	},
+	{
+		Name:        "paper",
+		Label:       "Paper",
+		Background:  "#efe6d2",
+		Surface:     "#fbf7ee",
+		Color:       "#3b3024",
+		Border:      "#c9b99a",
+		Accent:      "#8b5a2b",
+		AccentColor: "#fbf7ee",
+		Font:        "Georgia, Times New Roman, serif",
+	},
+}
+
+// Theme colors and fonts can only be plain CSS values so they can't break
+// out of the declarations they're put in
+var cssValue = regexp.MustCompile(`^[\w\s#%.,()'"+-]*$`)
+
+// Image types logos can be uploaded as and how big they can be
+var logoTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+const maxLogoSize = 512 << 10
+
+// How long a submission's idempotency key keeps it from being saved again
+const idempotencyTTL = 24 * time.Hour
+
+// What happens when an entry's unique fields match an earlier entry's:
+// it's rejected, replaces the earlier entry or replaces it and keeps what it
+// was as a version
+var uniqueActions = []string{"reject", "overwrite", "append"}
+
+// errDuplicate is returned by saveEntry when another submission claimed the
+// same unique values first and the form rejects those
+var errDuplicate = errors.New("Entry has already been submitted")
+
+// How long password reset links work for
+const resetTTL = time.Hour
+
+// How long links to confirm a new account's email work for
+const confirmTTL = 24 * time.Hour
+
+// How often an account's confirmation link can be emailed again
+const confirmResendInterval = 15 * time.Minute
+
+// How long workspace invites work for
+const inviteTTL = 7 * 24 * time.Hour
+
+// Passwords are hashed with bcrypt, which only looks at their first 72 bytes
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
 )
 
+// How long partially filled in responses to multi-step forms are kept
+const partialTTL = 30 * 24 * time.Hour
+
+// Stats periods and how many of them are charted
+var statsPeriods = map[string]struct {
+	Length  time.Duration
+	Buckets int
+}{
+	"day":  {24 * time.Hour, 30},
+	"week": {7 * 24 * time.Hour, 12},
+}
+
+// Entry meta fields and the query parameters they're captured from
+var utmParams = [][2]string{
+	{"UTMSource", "utm_source"},
+	{"UTMMedium", "utm_medium"},
+	{"UTMCampaign", "utm_campaign"},
+	{"UTMTerm", "utm_term"},
+	{"UTMContent", "utm_content"},
+}
+
 // Utils
 
 func key(args ...string) string {
@@ -64,6 +524,104 @@ func genID() string {
 	return fmt.Sprintf("%x", p)
 }
 
+// genToken returns an unguessable token for secrets like password reset
+// links and OAuth states, unlike genID which only has to be unique enough.
+func genToken() string {
+	p := make([]byte, 16)
+	if _, err := rand.Read(p); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", p)
+}
+
+// errorf is like fmt.Errorf but the error's message can be translated
+func errorf(format string, args ...interface{}) error {
+	return userError{format, args}
+}
+
+func loadCatalogs() error {
+	for _, lang := range languages {
+		if lang.Code == "en" {
+			continue
+		}
+		b, err := ioutil.ReadFile(fmt.Sprintf("locales/%s.json", lang.Code))
+		if err != nil {
+			return err
+		}
+		catalog := make(map[string]string)
+		if err := json.Unmarshal(b, &catalog); err != nil {
+			return fmt.Errorf("locales/%s.json: %s", lang.Code, err)
+		}
+		catalogs[lang.Code] = catalog
+	}
+	return nil
+}
+
+// translate looks up a message in lang's catalog, falling back to English,
+// and fills in its arguments.
+func translate(lang string, format string, args ...interface{}) string {
+	if t, ok := catalogs[lang][format]; ok && t != "" {
+		format = t
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+func translateError(lang string, err error) string {
+	if e, ok := err.(userError); ok {
+		return translate(lang, e.format, e.args...)
+	}
+	return translate(lang, err.Error())
+}
+
+func knownLanguage(code string) bool {
+	for _, lang := range languages {
+		if lang.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateLanguage picks the language to show a page in. A preferred
+// language wins, otherwise the best match in Accept-Language does.
+func negotiateLanguage(req *http.Request, preferred string) string {
+	if knownLanguage(preferred) {
+		return preferred
+	}
+
+	best, bestQ := "en", 0.0
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		params := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		// Match regional variants like es-MX to their base language
+		if i := strings.Index(tag, "-"); i != -1 {
+			tag = tag[:i]
+		}
+		if knownLanguage(tag) && q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// getLanguage returns the language sessionEnv picked for the request
+func getLanguage(c web.C) string {
+	if lang, ok := c.Env["lang"].(string); ok {
+		return lang
+	}
+	return "en"
+}
+
 func getMessages(c web.C, w http.ResponseWriter, req *http.Request) []Message {
 	session := c.Env["session"].(*sessions.Session)
 	var messages []Message
@@ -95,286 +653,5072 @@ func getForm(rc redis.Conn, k string, form *Form) error {
 	return nil
 }
 
-func createURL(req *http.Request) url.URL {
-	var url_ *url.URL
-	url_ = req.URL
-	url_.Scheme = "http"
-	fwdScheme := req.Header.Get("X-Forwarded-Proto")
-	if fwdScheme != "" {
-		url_.Scheme = fwdScheme
-	}
-	url_.Host = req.Host
-	url_.RawQuery = ""
-	url_.Fragment = ""
-	return *url_
-}
-
-func loginGoogleConfig(req *http.Request) *oauth2.Config {
-	redirectURL := createURL(req)
-	redirectURL.Path = "/oauth2callback"
-	fmt.Println(redirectURL.String())
-	return &oauth2.Config{
-		ClientID:     *googleClientID,
-		ClientSecret: *googleClientSecret,
-		RedirectURL:  redirectURL.String(),
-		Scopes:       []string{"email"},
-		Endpoint:     google.Endpoint,
-	}
+// getForms returns the forms someone created outside of any workspace.
+func getForms(rc redis.Conn, uid string) ([]Form, error) {
+	return getFormsIn(rc, key(uid, "forms"))
 }
 
-// Middlewares
-
-func requireLogin(c *web.C, h http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, req *http.Request) {
-		session := c.Env["session"].(*sessions.Session)
+// getFormsIn returns the forms whose IDs are in the set k.
+func getFormsIn(rc redis.Conn, k string) ([]Form, error) {
+	var forms []Form
 
-		uid, loggedIn := session.Values["uid"]
+	fids, err := redis.Strings(rc.Do("SMEMBERS", k))
+	if err != nil {
+		return nil, err
+	}
 
-		if !loggedIn {
-			gc := loginGoogleConfig(req)
-			authURL := gc.AuthCodeURL("")
-			http.Redirect(w, req, authURL, http.StatusFound)
-			return
+	for _, fid := range fids {
+		var form Form
+		err = getForm(rc, key("form", fid), &form)
+		if err != nil {
+			return nil, err
+		}
+		form.Unread, err = redis.Int64(rc.Do(
+			"SCARD",
+			key("form", fid, "unread"),
+		))
+		if err != nil {
+			return nil, err
 		}
+		forms = append(forms, form)
+	}
+	return forms, nil
+}
 
-		c.Env["uid"] = uid
+// getEntries returns a form's entries, newest first. filter can be "unread"
+// or "starred" and label limits the entries to those tagged with it.
+func getEntries(rc redis.Conn, fid string, filter string, label string) ([]Entry, error) {
+	var entries []Entry
 
-		h.ServeHTTP(w, req)
+	v, err := redis.Values(rc.Do(
+		"ZREVRANGEBYSCORE",
+		key("form", fid, "entries"),
+		"+inf", "-inf", "WITHSCORES",
+	))
+	if err != nil {
+		return nil, err
+	}
+	ems := make([]EntryMeta, len(v)/2)
+	for i := range ems {
+		v, err = redis.Scan(v, &ems[i].ID, &ems[i].Submitted)
 	}
-	return http.HandlerFunc(fn)
-}
 
-func sessionEnv(c *web.C, h http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, req *http.Request) {
-		session, err := rs.Get(req, "session")
+	for _, em := range ems {
+		var entry Entry
+		err = getEntry(rc, fid, em.ID, &entry)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		c.Env["session"] = session
-		h.ServeHTTP(w, req)
+		if filter == "unread" && !entry.Unread {
+			continue
+		}
+		if filter == "starred" && !entry.Starred {
+			continue
+		}
+		if label != "" && !contains(entry.Labels, label) {
+			continue
+		}
+		entries = append(entries, entry)
 	}
-	return http.HandlerFunc(fn)
+	return entries, nil
 }
 
-// Index
-
-func index(c web.C, w http.ResponseWriter, req *http.Request) {
-	r.HTML(w, http.StatusOK, "index", nil)
-}
-
-// Login
-
-func login(c web.C, w http.ResponseWriter, req *http.Request) {
-	var err error
+func getEntry(rc redis.Conn, fid string, eid string, entry *Entry) error {
+	submitted, err := redis.Int64(
+		rc.Do("ZSCORE", key("form", fid, "entries"), eid),
+	)
+	if err != nil {
+		return err
+	}
 
-	defer func() {
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}()
+	v, err := redis.Values(
+		rc.Do("HGETALL", key("form", fid, "entry", eid, "meta")),
+	)
+	if err != nil {
+		return err
+	}
+	redis.ScanStruct(v, &entry.EntryMeta)
+	entry.ID = eid
+	entry.Submitted = submitted
 
-	code := req.URL.Query().Get("code")
-	if code == "" {
-		http.Error(w, "", http.StatusForbidden)
-		return
+	fields, err := redis.Strings(
+		rc.Do("HGETALL", key("form", fid, "entry", eid)),
+	)
+	if err != nil {
+		return err
+	}
+	entry.Fields = make(map[string]string)
+	for i := 0; i < len(fields); i += 2 {
+		entry.Fields[fields[i]] = fields[i+1]
 	}
 
-	gc := loginGoogleConfig(req)
-	tok, err := gc.Exchange(oauth2.NoContext, code)
+	entry.Unread, err = redis.Bool(
+		rc.Do("SISMEMBER", key("form", fid, "unread"), eid),
+	)
 	if err != nil {
-		return
+		return err
 	}
 
-	cli := gc.Client(oauth2.NoContext, tok)
-	resp, err := cli.Get("https://www.googleapis.com/plus/v1/people/me")
+	entry.Starred, err = redis.Bool(
+		rc.Do("SISMEMBER", key("form", fid, "starred"), eid),
+	)
 	if err != nil {
-		return
+		return err
 	}
 
-	person, err := jason.NewObjectFromReader(resp.Body)
+	entry.Labels, err = redis.Strings(
+		rc.Do("SMEMBERS", key("form", fid, "entry", eid, "labels")),
+	)
 	if err != nil {
-		return
+		return err
 	}
+	sort.Strings(entry.Labels)
+	return nil
+}
 
-	emails, err := person.GetObjectArray("emails")
+// getComments returns an entry's comments, oldest first, with who wrote
+// them named by their profile instead of their user ID.
+func getComments(rc redis.Conn, fid string, eid string) ([]Comment, error) {
+	var comments []Comment
+	names := make(map[string]string)
+
+	cids, err := redis.Strings(rc.Do(
+		"ZRANGE",
+		key("form", fid, "entry", eid, "comments"),
+		0, -1,
+	))
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	var email string
-	for _, e := range emails {
-		email, err = e.GetString("value")
+	for _, cid := range cids {
+		var comment Comment
+		v, err := redis.Values(rc.Do(
+			"HGETALL",
+			key("form", fid, "entry", eid, "comment", cid),
+		))
 		if err != nil {
-			return
+			return nil, err
 		}
-		break
-	}
+		redis.ScanStruct(v, &comment)
 
-	loggedIn := false
-	if *googleAllowedEmails == "anyone" {
-		loggedIn = true
-	} else {
-		allowedEmails := strings.Split(*googleAllowedEmails, ",")
-		for _, allowedEmail := range allowedEmails {
-			if email == allowedEmail {
-				loggedIn = true
-				break
+		name, ok := names[comment.Author]
+		if !ok {
+			name, _ = redis.String(rc.Do("HGET", key(comment.Author, "profile"), "Name"))
+			if name == "" {
+				name = userEmail(rc, comment.Author)
+			}
+			if name == "" {
+				name = comment.Author
 			}
+			names[comment.Author] = name
 		}
+		comment.AuthorName = name
+
+		comments = append(comments, comment)
 	}
+	return comments, nil
+}
 
-	if loggedIn {
-		session, err := rs.Get(req, "session")
-		if err != nil {
-			return
-		}
+// getStats charts a form's submissions per period and compares them against
+// the same number of periods before that. Referrers and field values are
+// only counted for the charted periods.
+func getStats(rc redis.Conn, form Form, period string) (*Stats, error) {
+	p, ok := statsPeriods[period]
+	if !ok {
+		return nil, fmt.Errorf("Unknown period: %s", period)
+	}
 
-		uid, err := person.GetString("id")
-		if err != nil {
-			return
+	def, err := parseDefinition(form.Definition)
+	if err != nil {
+		return nil, err
+	}
+	choices := make(map[string]bool)
+	for _, field := range def.Fields {
+		switch field.Type {
+		case "select", "radio", "checkbox":
+			choices[field.Name] = true
 		}
+	}
 
-		session.Values["uid"] = uid
-		err = session.Save(req, w)
-		if err != nil {
-			return
-		}
+	fid := form.ID
 
-		http.Redirect(w, req, "/dashboard/", http.StatusFound)
-		return
+	stats := &Stats{
+		Period: period,
+		Series: make([]Bucket, p.Buckets),
+		Fields: make(map[string][]Count),
 	}
 
-	http.Redirect(w, req, "/", http.StatusFound)
-}
+	total, err := redis.Int64(rc.Do("ZCARD", key("form", fid, "entries")))
+	if err != nil {
+		return nil, err
+	}
+	stats.Total = total
+
+	length := int64(p.Length / time.Second)
+	start := time.Now().UTC().Truncate(p.Length).Unix() -
+		int64(p.Buckets-1)*length
+	for i := range stats.Series {
+		stats.Series[i].Start = start + int64(i)*length
+	}
+
+	v, err := redis.Values(rc.Do(
+		"ZRANGEBYSCORE",
+		key("form", fid, "entries"),
+		start-int64(p.Buckets)*length, "+inf", "WITHSCORES",
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	referrers := make(map[string]int)
+	values := make(map[string]map[string]int)
+	for len(v) > 0 {
+		var em EntryMeta
+		v, err = redis.Scan(v, &em.ID, &em.Submitted)
+		if err != nil {
+			return nil, err
+		}
+
+		if em.Submitted < start {
+			stats.Previous++
+			continue
+		}
+		stats.Current++
+
+		i := int((em.Submitted - start) / length)
+		if i >= len(stats.Series) {
+			i = len(stats.Series) - 1
+		}
+		stats.Series[i].Count++
+
+		referrer, err := redis.String(rc.Do(
+			"HGET",
+			key("form", fid, "entry", em.ID, "meta"),
+			"Referrer",
+		))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		host := "(direct)"
+		if ref, err := url.Parse(referrer); err == nil && ref.Host != "" {
+			host = ref.Host
+		}
+		referrers[host]++
+
+		fields, err := redis.Strings(rc.Do(
+			"HGETALL",
+			key("form", fid, "entry", em.ID),
+		))
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(fields); i += 2 {
+			if values[fields[i]] == nil {
+				values[fields[i]] = make(map[string]int)
+			}
+			values[fields[i]][fields[i+1]]++
+		}
+	}
+
+	if stats.Previous > 0 {
+		stats.Trend = (stats.Current - stats.Previous) * 100 / stats.Previous
+	}
+
+	max := 0
+	for _, b := range stats.Series {
+		if b.Count > max {
+			max = b.Count
+		}
+	}
+	if max > 0 {
+		for i := range stats.Series {
+			stats.Series[i].Percent = stats.Series[i].Count * 100 / max
+		}
+	}
+
+	stats.TopReferrers = topCounts(referrers, 10)
+
+	// Only multiple choice fields are worth a distribution. Forms without
+	// a definition get the fields that look like a choice between a few
+	// options.
+	for field, counts := range values {
+		if len(def.Fields) > 0 {
+			if !choices[field] {
+				continue
+			}
+		} else {
+			n := 0
+			for _, count := range counts {
+				n += count
+			}
+			if len(counts) > 10 || len(counts) == n {
+				continue
+			}
+		}
+		stats.Fields[field] = topCounts(counts, 10)
+	}
+
+	return stats, nil
+}
+
+func topCounts(m map[string]int, n int) []Count {
+	counts := []Count{}
+	for value, count := range m {
+		counts = append(counts, Count{value, count})
+	}
+	sort.Sort(byCount(counts))
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+func markEntry(rc redis.Conn, fid string, eid string, state string, on bool) error {
+	cmd := "SREM"
+	if on {
+		cmd = "SADD"
+	}
+	_, err := rc.Do(cmd, key("form", fid, state), eid)
+	return err
+}
+
+func setEntryLabels(rc redis.Conn, fid string, eid string, labels []string) error {
+	old, err := redis.Strings(
+		rc.Do("SMEMBERS", key("form", fid, "entry", eid, "labels")),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, label := range old {
+		_, err = rc.Do("SREM", key("form", fid, "label", label), eid)
+		if err != nil {
+			return err
+		}
+		n, err := redis.Int(rc.Do("SCARD", key("form", fid, "label", label)))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			rc.Do("SREM", key("form", fid, "labels"), label)
+		}
+	}
+
+	_, err = rc.Do("DEL", key("form", fid, "entry", eid, "labels"))
+	if err != nil {
+		return err
+	}
+
+	for _, label := range labels {
+		rc.Do("SADD", key("form", fid, "entry", eid, "labels"), label)
+		rc.Do("SADD", key("form", fid, "label", label), eid)
+		rc.Do("SADD", key("form", fid, "labels"), label)
+	}
+	return nil
+}
+
+func parseLabels(s string) []string {
+	labels := []string{}
+	for _, label := range strings.Split(s, ",") {
+		label = strings.TrimSpace(label)
+		if label != "" && !contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func entryExists(rc redis.Conn, fid string, eid string) (bool, error) {
+	return redis.Bool(rc.Do(
+		"EXISTS",
+		key("form", fid, "entry", eid),
+	))
+}
+
+func entryAt(rc redis.Conn, fid string, pos int64) (string, error) {
+	ids, err := redis.Strings(rc.Do(
+		"ZREVRANGE",
+		key("form", fid, "entries"),
+		pos, pos,
+	))
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, proxy := range strings.Split(*trustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if addr.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+
+	// Walk the forwarded chain from the nearest hop and stop at the first
+	// address we don't trust so clients can't spoof it
+	hops := strings.Split(
+		strings.Join(req.Header["X-Forwarded-For"], ","),
+		",",
+	)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			return ip
+		}
+	}
+
+	if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+	return ip
+}
+
+func utmValue(req *http.Request, param string) string {
+	if v := req.URL.Query().Get(param); v != "" {
+		return v
+	}
+	// Forms are usually posted from the landing page so fall back to the
+	// referrer's query string
+	ref, err := url.Parse(req.Referer())
+	if err != nil {
+		return ""
+	}
+	return ref.Query().Get(param)
+}
+
+func formatTime(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.Stamp)
+}
+
+func formatDate(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format("Jan 2")
+}
+
+// Times forms open and close at are picked with datetime-local inputs, in
+// UTC.
+const scheduleLayout = "2006-01-02T15:04"
+
+func formatSchedule(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+	return time.Unix(ts, 0).UTC().Format(scheduleLayout)
+}
+
+func parseSchedule(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(scheduleLayout, s)
+	if err != nil {
+		return 0, errorf("Invalid date: %s", s)
+	}
+	return t.Unix(), nil
+}
+
+// parseDefinition reads a form definition from its JSON representation and
+// fills in defaults for any fields that leave them out.
+func parseDefinition(s string) (Definition, error) {
+	var def Definition
+	if strings.TrimSpace(s) == "" {
+		return def, nil
+	}
+	if err := json.Unmarshal([]byte(s), &def); err != nil {
+		return def, errorf("Invalid form definition: %s", err.Error())
+	}
+
+	names := make(map[string]bool)
+	breaks := make(map[string]bool)
+	for i := range def.Fields {
+		field := &def.Fields[i]
+		field.Name = strings.TrimSpace(field.Name)
+		if field.Name == "" {
+			return def, errorf("Field %d needs a name", i+1)
+		}
+		if names[field.Name] {
+			return def, errorf("Field %s is defined twice", field.Name)
+		}
+		names[field.Name] = true
+
+		if field.Label == "" {
+			field.Label = strings.Title(field.Name)
+		}
+		if field.Type == "" {
+			field.Type = "text"
+		}
+		known := false
+		for _, t := range fieldTypes {
+			if field.Type == t {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return def, errorf(
+				"Field %s has an unknown type: %s",
+				field.Name, field.Type,
+			)
+		}
+		if field.Type == "page" {
+			breaks[field.Name] = true
+		}
+		if (field.Type == "select" || field.Type == "radio") &&
+			len(field.Options) == 0 {
+			return def, errorf("Field %s needs options", field.Name)
+		}
+	}
+
+	for i, rule := range def.Rules {
+		switch rule.Action {
+		case "show", "hide", "require":
+		default:
+			return def, errorf(
+				"Rule %d has an unknown action: %s",
+				i+1, rule.Action,
+			)
+		}
+		if !names[rule.Field] {
+			return def, errorf(
+				"Rule %d applies to an unknown field: %s",
+				i+1, rule.Field,
+			)
+		}
+		if !names[rule.When] {
+			return def, errorf(
+				"Rule %d depends on an unknown field: %s",
+				i+1, rule.When,
+			)
+		}
+		if breaks[rule.Field] || breaks[rule.When] {
+			return def, errorf("Rule %d refers to a page break", i+1)
+		}
+	}
+	return def, nil
+}
+
+// splitPages breaks a form's fields up into the pages its page breaks
+// start. Pages without any fields are left out.
+func splitPages(def Definition) []Page {
+	var pages []Page
+	page := Page{}
+	for _, field := range def.Fields {
+		if field.Type == "page" {
+			if len(page.Fields) > 0 {
+				pages = append(pages, page)
+			}
+			page = Page{Title: field.Label}
+			continue
+		}
+		page.Fields = append(page.Fields, field)
+	}
+	if len(page.Fields) > 0 || len(pages) == 0 {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// evaluateRules works out which fields a form's rules hide and which they
+// make required for the posted values. It mirrors formicRules in
+// static/js/rules.js so hosted forms behave the same on both ends.
+func evaluateRules(def Definition, values url.Values) (hidden map[string]bool, required map[string]bool) {
+	matches := func(rule Rule, hidden map[string]bool) bool {
+		return !hidden[rule.When] && contains(values[rule.When], rule.Equals)
+	}
+
+	// Hiding a field can change the outcome of rules that depend on it so
+	// keep going until that settles down
+	hidden = make(map[string]bool)
+	for pass := 0; pass <= len(def.Rules); pass++ {
+		next := make(map[string]bool)
+		for _, rule := range def.Rules {
+			m := matches(rule, hidden)
+			if (rule.Action == "show" && !m) || (rule.Action == "hide" && m) {
+				next[rule.Field] = true
+			}
+		}
+		if reflect.DeepEqual(next, hidden) {
+			break
+		}
+		hidden = next
+	}
+
+	required = make(map[string]bool)
+	for _, rule := range def.Rules {
+		if rule.Action == "require" && matches(rule, hidden) {
+			required[rule.Field] = true
+		}
+	}
+	return hidden, required
+}
+
+// validateEntry checks posted values against a form's definition and
+// returns error messages keyed by field name.
+func validateEntry(def Definition, values url.Values, lang string) map[string]string {
+	errs := make(map[string]string)
+	hidden, required := evaluateRules(def, values)
+	for _, field := range def.Fields {
+		if hidden[field.Name] || field.Type == "page" {
+			continue
+		}
+		v := strings.TrimSpace(strings.Join(values[field.Name], ""))
+		if v == "" {
+			if field.Required || required[field.Name] {
+				errs[field.Name] = translate(lang, "%s is required", field.Label)
+			}
+			continue
+		}
+
+		switch field.Type {
+		case "email":
+			if !strings.Contains(v, "@") {
+				errs[field.Name] = translate(
+					lang, "%s must be an email address", field.Label,
+				)
+			}
+		case "number":
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				errs[field.Name] = translate(lang, "%s must be a number", field.Label)
+			}
+		case "url":
+			if u, err := url.Parse(v); err != nil || u.Host == "" {
+				errs[field.Name] = translate(lang, "%s must be a URL", field.Label)
+			}
+		case "select", "radio", "checkbox":
+			if len(field.Options) == 0 {
+				continue
+			}
+			for _, choice := range values[field.Name] {
+				if !contains(field.Options, choice) {
+					errs[field.Name] = translate(
+						lang, "%s has an invalid choice", field.Label,
+					)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func formatDefinition(def Definition) string {
+	if len(def.Fields) == 0 && len(def.Rules) == 0 {
+		return ""
+	}
+	b, _ := json.MarshalIndent(def, "", "  ")
+	return string(b)
+}
+
+// formSnippet returns the HTML people can paste into their pages to post
+// to formURL.
+func formSnippet(formURL string, def Definition) string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "<form action=\"%s\" method=\"post\">\n", html.EscapeString(formURL))
+	if len(def.Fields) == 0 {
+		b.WriteString("  <p><input type=\"text\" name=\"name\" placeholder=\"Name\"></p>\n")
+		b.WriteString("  <p><input type=\"email\" name=\"email\" placeholder=\"Email\"></p>\n")
+		b.WriteString("  ...\n")
+	}
+	for _, field := range def.Fields {
+		if field.Type == "page" {
+			continue
+		}
+		name := html.EscapeString(field.Name)
+		label := html.EscapeString(field.Label)
+		placeholder := html.EscapeString(field.Placeholder)
+		required := ""
+		if field.Required {
+			required = " required"
+		}
+
+		b.WriteString("  <p>\n")
+		switch {
+		case field.Type == "checkbox" && len(field.Options) == 0:
+			fmt.Fprintf(&b, "    <label><input type=\"checkbox\" name=\"%s\" value=\"yes\"%s> %s</label>\n", name, required, label)
+		case field.Type == "checkbox" || field.Type == "radio":
+			fmt.Fprintf(&b, "    <label>%s</label>\n", label)
+			for _, option := range field.Options {
+				option = html.EscapeString(option)
+				fmt.Fprintf(&b, "    <label><input type=\"%s\" name=\"%s\" value=\"%s\"> %s</label>\n", field.Type, name, option, option)
+			}
+		case field.Type == "select":
+			fmt.Fprintf(&b, "    <label>%s</label>\n", label)
+			fmt.Fprintf(&b, "    <select name=\"%s\"%s>\n", name, required)
+			fmt.Fprintf(&b, "      <option value=\"\">%s</option>\n", placeholder)
+			for _, option := range field.Options {
+				option = html.EscapeString(option)
+				fmt.Fprintf(&b, "      <option>%s</option>\n", option)
+			}
+			b.WriteString("    </select>\n")
+		case field.Type == "textarea":
+			fmt.Fprintf(&b, "    <label>%s</label>\n", label)
+			fmt.Fprintf(&b, "    <textarea name=\"%s\" placeholder=\"%s\"%s></textarea>\n", name, placeholder, required)
+		default:
+			fmt.Fprintf(&b, "    <label>%s</label>\n", label)
+			fmt.Fprintf(&b, "    <input type=\"%s\" name=\"%s\" placeholder=\"%s\"%s>\n", field.Type, name, placeholder, required)
+		}
+		b.WriteString("  </p>\n")
+	}
+	b.WriteString("  <p><button type=\"submit\">Submit</button></p>\n")
+	b.WriteString("</form>")
+
+	return b.String()
+}
+
+// entryMeta returns the details of a submission the form is set to capture
+func entryMeta(req *http.Request, form Form) url.Values {
+	meta := url.Values{}
+	if !form.IgnoreIP {
+		meta.Set("IP", remoteIP(req))
+	}
+	if !form.IgnoreUserAgent {
+		meta.Set("UserAgent", req.UserAgent())
+	}
+	if !form.IgnoreReferrer {
+		meta.Set("Referrer", req.Referer())
+		meta.Set("Origin", req.Header.Get("Origin"))
+	}
+	if !form.IgnoreUTM {
+		for _, utm := range utmParams {
+			if v := utmValue(req, utm[1]); v != "" {
+				meta.Set(utm[0], v)
+			}
+		}
+	}
+	return meta
+}
+
+// saveEntry stores values that passed validation as a new entry, or as entry
+// eid if it's not empty, and returns its ID. New entries claim their unique
+// values first so two submissions can't both take them.
+func saveEntry(rc redis.Conn, form Form, def Definition, eid string, values url.Values, meta url.Values) (string, error) {
+	// Fields the form's rules hid weren't meant to be filled in
+	hidden, _ := evaluateRules(def, values)
+
+	// Locked forms only take the fields they already have
+	var known []string
+	if form.LockFields {
+		var err error
+		known, err = redis.Strings(rc.Do("SMEMBERS", key("form", form.ID, "fields")))
+		if err != nil {
+			return "", err
+		}
+		for _, field := range def.Fields {
+			known = append(known, field.Name)
+		}
+	}
+
+	// New entries claim their unique values before they're written, in case
+	// another submission took them since checkUnique looked
+	unique := uniqueValue(form, values)
+	replace := eid != ""
+	claimed := false
+	if !replace {
+		eid = genID()
+		if unique != "" {
+			var err error
+			claimed, err = redis.Bool(rc.Do("HSETNX", key("form", form.ID, "unique"), unique, eid))
+			if err != nil {
+				return "", err
+			}
+			if !claimed {
+				if form.UniqueAction == "reject" {
+					return "", errDuplicate
+				}
+				existing, err := findUnique(rc, form, values)
+				if err != nil {
+					return "", err
+				}
+				if existing != "" {
+					eid, replace = existing, true
+				}
+			}
+		}
+	}
+
+	if replace {
+		if form.UniqueAction == "append" {
+			if err := archiveEntry(rc, form.ID, eid); err != nil {
+				return "", err
+			}
+		}
+		rc.Do("DEL",
+			key("form", form.ID, "entry", eid),
+			key("form", form.ID, "entry", eid, "meta"),
+		)
+	}
+
+	entry := []interface{}{key("form", form.ID, "entry", eid)}
+	for field, v := range values {
+		if hidden[field] || (form.LockFields && !contains(known, field)) {
+			continue
+		}
+		entry = append(entry, field, strings.Join(v, ", "))
+		rc.Do("SADD", key("form", form.ID, "fields"), field)
+	}
+	// Entries that couldn't be saved let go of their unique values again
+	release := func() {
+		if claimed {
+			rc.Do("HDEL", key("form", form.ID, "unique"), unique)
+		}
+	}
+	if len(entry) > 1 {
+		if _, err := rc.Do("HMSET", entry...); err != nil {
+			release()
+			return "", err
+		}
+	}
+
+	m := []interface{}{key("form", form.ID, "entry", eid, "meta")}
+	for k := range meta {
+		m = append(m, k, meta.Get(k))
+	}
+	if len(m) > 1 {
+		rc.Do("HMSET", m...)
+	}
+
+	_, err := rc.Do("ZADD", key("form", form.ID, "entries"), time.Now().UTC().Unix(), eid)
+	if err != nil {
+		release()
+		return "", err
+	}
+
+	rc.Do("SADD", key("form", form.ID, "unread"), eid)
+
+	if unique != "" && !claimed {
+		rc.Do("HSET", key("form", form.ID, "unique"), unique, eid)
+	}
+
+	return eid, nil
+}
+
+// parseSubmission reads a submitted entry within the configured limits. It
+// returns the status to respond with if it can't.
+func parseSubmission(w http.ResponseWriter, req *http.Request) (int, error) {
+	if *maxBodySize > 0 {
+		if req.ContentLength > *maxBodySize {
+			return http.StatusRequestEntityTooLarge, errorf(
+				"Submissions can't be larger than %d bytes", *maxBodySize,
+			)
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, *maxBodySize)
+	}
+
+	if err := req.ParseForm(); err != nil {
+		// Bodies without a length, like chunked ones, are only found to be
+		// too large while they're read
+		if strings.Contains(err.Error(), "request body too large") {
+			return http.StatusRequestEntityTooLarge, errorf(
+				"Submissions can't be larger than %d bytes", *maxBodySize,
+			)
+		}
+		return http.StatusBadRequest, errorf("Couldn't read the submission: %s", err.Error())
+	}
+
+	if *maxFields > 0 && len(req.PostForm) > *maxFields {
+		return http.StatusBadRequest, errorf(
+			"Submissions can't have more than %d fields", *maxFields,
+		)
+	}
+	if *maxValueLength > 0 {
+		for name, values := range req.PostForm {
+			if utf8.RuneCountInString(name) > *maxValueLength {
+				return http.StatusBadRequest, errorf(
+					"Field names can't be longer than %d characters", *maxValueLength,
+				)
+			}
+			for _, v := range values {
+				if utf8.RuneCountInString(v) > *maxValueLength {
+					return http.StatusBadRequest, errorf(
+						"%s can't be longer than %d characters", name, *maxValueLength,
+					)
+				}
+			}
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// rejectSubmission responds to a submission that couldn't be taken.
+func rejectSubmission(w http.ResponseWriter, req *http.Request, status int, lang string, err error) {
+	if wantsJSON(req) {
+		r.JSON(w, status, map[string]string{
+			"Error": translateError(lang, err),
+		})
+		return
+	}
+	http.Error(w, translateError(lang, err), status)
+}
+
+// claimIdempotencyKey marks a submission with idempotency key k as being
+// saved. If an earlier submission with the same key was already saved, the
+// ID of its entry is returned instead.
+func claimIdempotencyKey(rc redis.Conn, fid string, k string) (string, error) {
+	if len(k) > 255 {
+		return "", errorf("Idempotency keys can't be longer than 255 characters")
+	}
+
+	_, err := redis.String(rc.Do(
+		"SET", key("form", fid, "idempotency", k), "",
+		"EX", int64(idempotencyTTL/time.Second), "NX",
+	))
+	if err == nil {
+		return "", nil
+	}
+	if err != redis.ErrNil {
+		return "", err
+	}
+
+	eid, err := redis.String(rc.Do("GET", key("form", fid, "idempotency", k)))
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+	if eid == "" {
+		return "", errorf("This submission is already being saved")
+	}
+	return eid, nil
+}
+
+// releaseIdempotencyKey records the entry a submission with idempotency key
+// k was saved as, or frees the key up if it wasn't saved.
+func releaseIdempotencyKey(rc redis.Conn, fid string, k string, eid string) {
+	if eid == "" {
+		rc.Do("DEL", key("form", fid, "idempotency", k))
+		return
+	}
+	rc.Do("SET", key("form", fid, "idempotency", k), eid,
+		"EX", int64(idempotencyTTL/time.Second))
+}
+
+// uniqueFields returns the fields that together identify a form's entries
+func uniqueFields(form Form) []string {
+	var fields []string
+	for _, field := range strings.Split(form.UniqueFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// uniqueValue returns the key entries are looked up by in a form's unique
+// index: the values of its unique fields, compared case-insensitively. It's
+// empty if any of them weren't filled in.
+func uniqueValue(form Form, values url.Values) string {
+	fields := uniqueFields(form)
+	if len(fields) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, field := range fields {
+		v := strings.ToLower(strings.TrimSpace(strings.Join(values[field], ", ")))
+		if v == "" {
+			return ""
+		}
+		parts = append(parts, v)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// findUnique returns the ID of the entry whose unique fields have the same
+// values as values, if any.
+func findUnique(rc redis.Conn, form Form, values url.Values) (string, error) {
+	v := uniqueValue(form, values)
+	if v == "" {
+		return "", nil
+	}
+	eid, err := redis.String(rc.Do("HGET", key("form", form.ID, "unique"), v))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return eid, err
+}
+
+// checkUnique adds an error to errs if values repeat an earlier entry's
+// unique fields and the form rejects those. It returns the entry to replace
+// if the form replaces them instead.
+func checkUnique(rc redis.Conn, form Form, def Definition, values url.Values, errs map[string]string, lang string) (string, error) {
+	eid, err := findUnique(rc, form, values)
+	if err != nil || eid == "" || form.UniqueAction != "reject" {
+		return eid, err
+	}
+
+	fields := uniqueFields(form)
+	var labels []string
+	for _, name := range fields {
+		label := name
+		for _, field := range def.Fields {
+			if field.Name == name {
+				label = field.Label
+			}
+		}
+		labels = append(labels, label)
+	}
+	if len(labels) == 1 {
+		errs[fields[0]] = translate(lang, "%s has already been submitted", labels[0])
+	} else {
+		errs[fields[0]] = translate(
+			lang, "This combination of %s has already been submitted",
+			strings.Join(labels, ", "),
+		)
+	}
+	return "", nil
+}
+
+// indexUnique fills in the index of a form's unique fields with its
+// existing entries. The oldest entry wins when several share values.
+func indexUnique(rc redis.Conn, form Form) error {
+	k := key("form", form.ID, "unique")
+	rc.Do("DEL", k)
+	fields := uniqueFields(form)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	eids, err := redis.Strings(rc.Do("ZRANGE", key("form", form.ID, "entries"), 0, -1))
+	if err != nil {
+		return err
+	}
+	for _, eid := range eids {
+		args := []interface{}{key("form", form.ID, "entry", eid)}
+		for _, field := range fields {
+			args = append(args, field)
+		}
+		v, err := redis.Strings(rc.Do("HMGET", args...))
+		if err != nil {
+			return err
+		}
+		values := url.Values{}
+		for i, field := range fields {
+			values.Set(field, v[i])
+		}
+		if v := uniqueValue(form, values); v != "" {
+			rc.Do("HSETNX", k, v, eid)
+		}
+	}
+	return nil
+}
+
+// archiveEntry keeps what an entry is now as one of its versions before it's
+// replaced.
+func archiveEntry(rc redis.Conn, fid string, eid string) error {
+	submitted, err := redis.Int64(rc.Do("ZSCORE", key("form", fid, "entries"), eid))
+	if err != nil {
+		return err
+	}
+
+	vid := genID()
+	fields, err := redis.Values(rc.Do("HGETALL", key("form", fid, "entry", eid)))
+	if err != nil {
+		return err
+	}
+	if len(fields) > 0 {
+		args := append([]interface{}{key("form", fid, "entry", eid, "version", vid)}, fields...)
+		if _, err := rc.Do("HMSET", args...); err != nil {
+			return err
+		}
+	}
+
+	_, err = rc.Do("ZADD", key("form", fid, "entry", eid, "versions"), submitted, vid)
+	return err
+}
+
+// getVersions returns an entry's earlier versions, newest first.
+func getVersions(rc redis.Conn, fid string, eid string) ([]Version, error) {
+	v, err := redis.Values(rc.Do(
+		"ZREVRANGEBYSCORE",
+		key("form", fid, "entry", eid, "versions"),
+		"+inf", "-inf", "WITHSCORES",
+	))
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, len(v)/2)
+	for i := range versions {
+		v, err = redis.Scan(v, &versions[i].ID, &versions[i].Submitted)
+		if err != nil {
+			return nil, err
+		}
+
+		fields, err := redis.Strings(rc.Do(
+			"HGETALL",
+			key("form", fid, "entry", eid, "version", versions[i].ID),
+		))
+		if err != nil {
+			return nil, err
+		}
+		versions[i].Fields = make(map[string]string)
+		for j := 0; j < len(fields); j += 2 {
+			versions[i].Fields[fields[j]] = fields[j+1]
+		}
+	}
+	return versions, nil
+}
+
+// parseRedirect checks a redirect URL template. See expandRedirect.
+func parseRedirect(s string) (*texttemplate.Template, error) {
+	t, err := texttemplate.New("redirect").Option("missingkey=zero").Parse(s)
+	if err != nil {
+		return nil, errorf("Invalid redirect URL: %s", err.Error())
+	}
+	return t, nil
+}
+
+// checkRedirect makes sure a redirect URL, or the fixed part of a
+// template, is an http(s) URL to a domain redirects are allowed to.
+func checkRedirect(s string) error {
+	if _, err := parseRedirect(s); err != nil {
+		return err
+	}
+
+	// Templates can't be allowed to pick the host
+	prefix := s
+	if i := strings.Index(s, "{{"); i >= 0 {
+		prefix = s[:i]
+		host := prefix
+		if j := strings.Index(host, "://"); j >= 0 {
+			host = host[j+3:]
+		}
+		if !strings.ContainsAny(host, "/?#") {
+			return errorf("Redirect URLs can't use fields in their domain")
+		}
+	}
+
+	u, err := url.Parse(prefix)
+	if err != nil {
+		return errorf("Invalid redirect URL: %s", err.Error())
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		return errorf("Redirect URLs have to start with http:// or https://")
+	}
+	if u.Host == "" {
+		return errorf("Redirect URLs need a domain")
+	}
+	if !allowedRedirect(u.Hostname()) {
+		return errorf("Redirects to %s aren't allowed", u.Hostname())
+	}
+	return nil
+}
+
+// allowedRedirect reports whether a host is one of the redirect-domains,
+// or a subdomain of one. Any host is allowed if none are set.
+func allowedRedirect(host string) bool {
+	if strings.TrimSpace(*redirectDomains) == "" {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range strings.Split(*redirectDomains, ",") {
+		domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "*.")
+		if domain == "" {
+			continue
+		}
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandRedirect fills in a redirect URL template with the form and entry
+// IDs and the submitted fields. Field values are escaped so they can go in
+// the URL's query string.
+func expandRedirect(s string, form Form, eid string, values url.Values, errs map[string]string) (string, error) {
+	t, err := parseRedirect(s)
+	if err != nil {
+		return "", err
+	}
+
+	fields := make(map[string]string)
+	for name, v := range values {
+		fields[name] = url.QueryEscape(strings.Join(v, ", "))
+	}
+	var messages []string
+	for _, message := range errs {
+		messages = append(messages, message)
+	}
+	sort.Strings(messages)
+
+	var b bytes.Buffer
+	err = t.Execute(&b, map[string]interface{}{
+		"FormID":  form.ID,
+		"EntryID": eid,
+		"Fields":  fields,
+		"Error":   url.QueryEscape(strings.Join(messages, "\n")),
+	})
+	return b.String(), err
+}
+
+// redirectSubmitted sends people who submitted a form to its redirect URL
+// or the thank-you page.
+func redirectSubmitted(w http.ResponseWriter, req *http.Request, form Form, eid string, values url.Values) {
+	thanks := fmt.Sprintf("/f/%s/thanks", form.ID)
+	if form.RedirectURL == "" {
+		http.Redirect(w, req, thanks, http.StatusFound)
+		return
+	}
+
+	url, err := expandRedirect(form.RedirectURL, form, eid, values, nil)
+	if err == nil {
+		// Forms saved before redirect-domains was changed can still point
+		// elsewhere
+		err = checkRedirect(url)
+	}
+	if err != nil {
+		// The entry's already been saved so there's no use in failing now
+		log.Printf("Couldn't redirect to redirect URL of form %s: %s", form.ID, err)
+		url = thanks
+	}
+	http.Redirect(w, req, url, http.StatusFound)
+}
+
+// renderMarkdown turns the basics of Markdown into HTML: headings,
+// paragraphs, lists, links, **bold**, *italics* and `code`. Everything
+// else is escaped.
+func renderMarkdown(s string) template.HTML {
+	var (
+		b    bytes.Buffer
+		para []string
+		list string
+	)
+	flush := func() {
+		if len(para) > 0 {
+			fmt.Fprintf(&b, "<p>%s</p>\n", markdownInline(strings.Join(para, "\n")))
+			para = nil
+		}
+		if list != "" {
+			fmt.Fprintf(&b, "</%s>\n", list)
+			list = ""
+		}
+	}
+
+	for _, line := range strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n") {
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			flush()
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", len(m[1]), markdownInline(m[2]), len(m[1]))
+			continue
+		}
+
+		tag := "ul"
+		m := mdBullet.FindStringSubmatch(line)
+		if m == nil {
+			tag = "ol"
+			m = mdOrdered.FindStringSubmatch(line)
+		}
+		if m != nil {
+			if len(para) > 0 || list != tag {
+				flush()
+				fmt.Fprintf(&b, "<%s>\n", tag)
+				list = tag
+			}
+			fmt.Fprintf(&b, "<li>%s</li>\n", markdownInline(m[1]))
+			continue
+		}
+
+		if list != "" {
+			flush()
+		}
+		para = append(para, line)
+	}
+	flush()
+
+	return template.HTML(b.String())
+}
+
+func markdownInline(s string) string {
+	em := func(s string) string {
+		return mdEm.ReplaceAllString(s, "<em>$1</em>")
+	}
+	// Italics are found inside and around bold text but not across it so
+	// the tags always nest
+	emphasis := func(s string) string {
+		s = html.EscapeString(s)
+		var b bytes.Buffer
+		last := 0
+		for _, m := range mdStrong.FindAllStringSubmatchIndex(s, -1) {
+			b.WriteString(em(s[last:m[0]]))
+			fmt.Fprintf(&b, "<strong>%s</strong>", em(s[m[2]:m[3]]))
+			last = m[1]
+		}
+		b.WriteString(em(s[last:]))
+		return b.String()
+	}
+
+	// Code and links are picked out first so their contents don't get
+	// mistaken for emphasis
+	var b bytes.Buffer
+	last := 0
+	for _, m := range mdToken.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(emphasis(s[last:m[0]]))
+		if m[2] != -1 {
+			fmt.Fprintf(&b, "<code>%s</code>", html.EscapeString(s[m[2]:m[3]]))
+		} else {
+			text, href := s[m[4]:m[5]], s[m[6]:m[7]]
+			if safeLink(href) {
+				fmt.Fprintf(&b, "<a href=\"%s\">%s</a>", html.EscapeString(href), emphasis(text))
+			} else {
+				b.WriteString(emphasis(text))
+			}
+		}
+		last = m[1]
+	}
+	b.WriteString(emphasis(s[last:]))
+	return b.String()
+}
+
+// safeLink reports whether links in Markdown can point to href. Browsers
+// treat "/\" like "//", which would leave the site.
+func safeLink(href string) bool {
+	for _, prefix := range []string{"http://", "https://", "mailto:", "/", "#"} {
+		if strings.HasPrefix(strings.ToLower(href), prefix) {
+			return !strings.HasPrefix(href, "//") && !strings.HasPrefix(href, "/\\")
+		}
+	}
+	return false
+}
+
+// getPartial loads a partially filled in response to a multi-step form.
+// It's left empty if the token doesn't match one or it has expired.
+func getPartial(rc redis.Conn, fid string, token string, partial *Partial) error {
+	v, err := redis.Strings(rc.Do(
+		"HMGET", key("form", fid, "partial", token),
+		"Page", "Values", "Meta", "Updated",
+	))
+	if err != nil || v[3] == "" {
+		return err
+	}
+
+	partial.Token = token
+	partial.Page, _ = strconv.Atoi(v[0])
+	partial.Updated, _ = strconv.ParseInt(v[3], 10, 64)
+	if partial.Values, err = url.ParseQuery(v[1]); err != nil {
+		return err
+	}
+	partial.Meta, err = url.ParseQuery(v[2])
+	return err
+}
+
+func savePartial(rc redis.Conn, fid string, partial *Partial) error {
+	now := time.Now().UTC()
+	partial.Updated = now.Unix()
+
+	k := key("form", fid, "partial", partial.Token)
+	_, err := rc.Do("HMSET", k,
+		"Page", partial.Page,
+		"Values", partial.Values.Encode(),
+		"Meta", partial.Meta.Encode(),
+		"Updated", partial.Updated,
+	)
+	if err != nil {
+		return err
+	}
+	rc.Do("EXPIRE", k, int(partialTTL.Seconds()))
+
+	// Keep track of the ones in progress so they can be counted
+	rc.Do("ZADD", key("form", fid, "partials"), partial.Updated, partial.Token)
+	rc.Do(
+		"ZREMRANGEBYSCORE", key("form", fid, "partials"),
+		"-inf", now.Add(-partialTTL).Unix(),
+	)
+	return nil
+}
+
+func deletePartial(rc redis.Conn, fid string, token string) {
+	rc.Do("DEL", key("form", fid, "partial", token))
+	rc.Do("ZREM", key("form", fid, "partials"), token)
+}
+
+func findTheme(name string) Theme {
+	for _, theme := range themes {
+		if theme.Name == name {
+			return theme
+		}
+	}
+	return themes[0]
+}
+
+// formTheme returns a form's theme along with the colors, font and CSS it
+// overrides.
+func formTheme(form Form) Theme {
+	theme := findTheme(form.Theme)
+	if form.ThemeBackground != "" {
+		theme.Background = template.CSS(form.ThemeBackground)
+	}
+	if form.ThemeColor != "" {
+		theme.Color = template.CSS(form.ThemeColor)
+	}
+	if form.ThemeAccent != "" {
+		theme.Accent = template.CSS(form.ThemeAccent)
+	}
+	if form.ThemeFont != "" {
+		theme.Font = template.CSS(form.ThemeFont)
+	}
+	theme.CSS = template.CSS(form.CustomCSS)
+	return theme
+}
+
+// renderPublic renders a page people who fill in a form see, styled with
+// the form's theme.
+func renderPublic(w http.ResponseWriter, req *http.Request, status int, name string, form Form, binding map[string]interface{}) {
+	binding["Form"] = form
+	binding["Lang"] = negotiateLanguage(req, form.Language)
+	binding["Theme"] = formTheme(form)
+	r.HTML(w, status, name, binding, render.HTMLOptions{Layout: "public"})
+}
+
+func wantsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// emailURL is the address of path to put in emails. It's built from base-url
+// instead of the request so a forged Host header can't send the link
+// somewhere else.
+func emailURL(path string) string {
+	return strings.TrimRight(*baseURL, "/") + path
+}
+
+func createURL(req *http.Request) url.URL {
+	var url_ *url.URL
+	url_ = req.URL
+	url_.Scheme = "http"
+	fwdScheme := req.Header.Get("X-Forwarded-Proto")
+	if fwdScheme != "" {
+		url_.Scheme = fwdScheme
+	}
+	url_.Host = req.Host
+	url_.RawQuery = ""
+	url_.Fragment = ""
+	return *url_
+}
+
+func staticEndpoint(e oauth2.Endpoint) func() (oauth2.Endpoint, error) {
+	return func() (oauth2.Endpoint, error) {
+		return e, nil
+	}
+}
+
+func enabledProviders() []*Provider {
+	var enabled []*Provider
+	for _, p := range providers {
+		if *p.ClientID != "" {
+			enabled = append(enabled, p)
+		}
+	}
+	return enabled
+}
+
+func findProvider(name string) *Provider {
+	for _, p := range enabledProviders() {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// loginConfig is the OAuth 2.0 configuration for logging in with p. Every
+// provider redirects back to /oauth2callback.
+func loginConfig(req *http.Request, p *Provider) (*oauth2.Config, error) {
+	endpoint, err := p.Endpoint()
+	if err != nil {
+		return nil, err
+	}
+	redirectURL := createURL(req)
+	redirectURL.Path = "/oauth2callback"
+	return &oauth2.Config{
+		ClientID:     *p.ClientID,
+		ClientSecret: *p.ClientSecret,
+		RedirectURL:  redirectURL.String(),
+		Scopes:       p.Scopes,
+		Endpoint:     endpoint,
+	}, nil
+}
+
+// getJSON fetches a JSON object with a client logged in to a provider.
+func getJSON(cli *http.Client, url string) (*jason.Object, error) {
+	resp, err := cli.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return jason.NewObjectFromReader(resp.Body)
+}
+
+// discoverOIDC fetches the OpenID provider's configuration from its issuer.
+func discoverOIDC() (*jason.Object, error) {
+	u := strings.TrimRight(*oidcIssuer, "/") + "/.well-known/openid-configuration"
+	return getJSON(&http.Client{Timeout: 10 * time.Second}, u)
+}
+
+// oidcUser reads who logged in from an OpenID Connect userinfo endpoint.
+func oidcUser(cli *http.Client, url string) (User, error) {
+	info, err := getJSON(cli, url)
+	if err != nil {
+		return User{}, err
+	}
+	sub, err := info.GetString("sub")
+	if err != nil {
+		return User{}, err
+	}
+	email, _ := info.GetString("email")
+	if verified, err := info.GetBoolean("email_verified"); err == nil && !verified {
+		email = ""
+	}
+	name, _ := info.GetString("name")
+	return User{ID: sub, Email: email, Name: name}, nil
+}
+
+func githubUser(cli *http.Client) (User, error) {
+	info, err := getJSON(cli, "https://api.github.com/user")
+	if err != nil {
+		return User{}, err
+	}
+	id, err := info.GetNumber("id")
+	if err != nil {
+		return User{}, err
+	}
+	name, _ := info.GetString("name")
+	user := User{ID: id.String(), Name: name}
+
+	// The profile's email is only there if it's public
+	resp, err := cli.Get("https://api.github.com/user/emails")
+	if err != nil {
+		return User{}, err
+	}
+	defer resp.Body.Close()
+	emails, err := jason.NewValueFromReader(resp.Body)
+	if err != nil {
+		return User{}, err
+	}
+	list, err := emails.Array()
+	if err != nil {
+		return User{}, err
+	}
+	for _, v := range list {
+		e, err := v.Object()
+		if err != nil {
+			return User{}, err
+		}
+		primary, _ := e.GetBoolean("primary")
+		verified, _ := e.GetBoolean("verified")
+		if primary && verified {
+			user.Email, _ = e.GetString("email")
+		}
+	}
+	return user, nil
+}
+
+func gitlabUser(cli *http.Client) (User, error) {
+	info, err := getJSON(cli, strings.TrimRight(*gitlabURL, "/")+"/api/v4/user")
+	if err != nil {
+		return User{}, err
+	}
+	id, err := info.GetNumber("id")
+	if err != nil {
+		return User{}, err
+	}
+	email, _ := info.GetString("email")
+	name, _ := info.GetString("name")
+	return User{ID: id.String(), Email: email, Name: name}, nil
+}
+
+// loginRedirect is where people who aren't logged in are sent: straight to
+// the only way to log in or to the index page to pick one.
+func loginRedirect() string {
+	enabled := enabledProviders()
+	switch {
+	case *localAccounts && len(enabled) == 0:
+		return "/login"
+	case !*localAccounts && len(enabled) == 1:
+		return "/login/" + enabled[0].Name
+	}
+	return "/"
+}
+
+// Access
+
+// What checkAccess decided about someone logging in
+const (
+	accessAllowed = iota
+	accessPending
+	accessDenied
+)
+
+func splitRules(s string) []string {
+	var rules []string
+	for _, rule := range strings.Split(s, ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// matchEmail reports whether email matches rule: an exact address, a whole
+// domain like "@company.com", a pattern with * and ? wildcards like
+// "*@*.company.com" or "anyone".
+func matchEmail(rule string, email string) bool {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	email = strings.ToLower(strings.TrimSpace(email))
+	switch {
+	case rule == "" || email == "":
+		return false
+	case rule == "anyone":
+		return true
+	case strings.HasPrefix(rule, "@"):
+		return strings.HasSuffix(email, rule)
+	case strings.ContainsAny(rule, "*?["):
+		matched, _ := path.Match(rule, email)
+		return matched
+	}
+	return rule == email
+}
+
+func matchAny(rules []string, email string) bool {
+	for _, rule := range rules {
+		if matchEmail(rule, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleConfig holds the access rules from the config. They're copied out of
+// the flags at startup and read again from formic.toml on SIGHUP, so
+// they're guarded by a lock instead of being read from the flags directly.
+var ruleConfig struct {
+	sync.RWMutex
+	allowed, denied, admins string
+}
+
+// configRules returns the allow, deny and admin rules from the config.
+func configRules() ([]string, []string, []string) {
+	ruleConfig.RLock()
+	defer ruleConfig.RUnlock()
+	return splitRules(ruleConfig.allowed), splitRules(ruleConfig.denied),
+		splitRules(ruleConfig.admins)
+}
+
+// setConfigRules replaces the access rules from the config. allowed-emails
+// takes precedence over the older google-allowed-emails.
+func setConfigRules(allowed, googleAllowed, denied, admin string) {
+	if allowed == "" {
+		allowed = googleAllowed
+	}
+	ruleConfig.Lock()
+	defer ruleConfig.Unlock()
+	ruleConfig.allowed, ruleConfig.denied, ruleConfig.admins =
+		allowed, denied, admin
+}
+
+// reloadConfigRules reads the access rules from a config file and the
+// environment again the way drone/config does at startup. It can't reuse a
+// ConfigSet since those refuse files with settings they don't define.
+func reloadConfigRules(path string) error {
+	settings := make(map[string]string)
+	tree, err := toml.LoadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if tree != nil {
+		flattenConfig(tree, nil, settings)
+	}
+	names := []string{
+		"allowed-emails", "google-allowed-emails", "denied-emails", "admins",
+	}
+	for _, n := range names {
+		env := "FORMIC_" + strings.ToUpper(strings.Replace(n, "-", "_", -1))
+		if v := os.Getenv(env); v != "" {
+			settings[n] = v
+		}
+	}
+	setConfigRules(settings[names[0]], settings[names[1]], settings[names[2]],
+		settings[names[3]])
+	return nil
+}
+
+// flattenConfig names the settings in a TOML tree like drone/config does,
+// so [google] allowed_emails is google-allowed-emails.
+func flattenConfig(tree *toml.TomlTree, path []string, settings map[string]string) {
+	for _, k := range tree.Keys() {
+		name := append(append([]string{}, path...), k)
+		switch v := tree.Get(k).(type) {
+		case *toml.TomlTree:
+			flattenConfig(v, name, settings)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprintf("%v", item)
+			}
+			settings[configName(name)] = strings.Join(items, ",")
+		default:
+			settings[configName(name)] = fmt.Sprintf("%v", v)
+		}
+	}
+}
+
+func configName(path []string) string {
+	return strings.Replace(strings.Join(path, "-"), "_", "-", -1)
+}
+
+// accessRules returns the allow and deny rules from the config followed by
+// the ones admins added from the dashboard.
+func accessRules(rc redis.Conn) ([]string, []string, error) {
+	configAllow, configDeny, _ := configRules()
+	allow, err := redis.Strings(rc.Do("SMEMBERS", key("access", "allow")))
+	if err != nil {
+		return nil, nil, err
+	}
+	deny, err := redis.Strings(rc.Do("SMEMBERS", key("access", "deny")))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(allow)
+	sort.Strings(deny)
+	return append(configAllow, allow...), append(configDeny, deny...), nil
+}
+
+func isAdmin(email string) bool {
+	_, _, admin := configRules()
+	return matchAny(admin, email)
+}
+
+// userEmail returns the email someone logged in with. Local accounts don't
+// have one until they've confirmed it's theirs.
+func userEmail(rc redis.Conn, uid string) string {
+	profile, err := redis.Strings(rc.Do("HMGET", key(uid, "profile"), "Email", "Provider"))
+	if err != nil || profile[0] == "" {
+		return ""
+	}
+	if profile[1] == "local" {
+		account, err := redis.Strings(rc.Do(
+			"HMGET", key("account", strings.ToLower(profile[0])), "ID", "Confirmed",
+		))
+		if err != nil || "local:"+account[0] != uid || account[1] != "1" {
+			return ""
+		}
+	}
+	return profile[0]
+}
+
+// checkAccess decides whether someone with email can log in. Rules are read
+// on every login so changes made by admins apply straight away. Denied
+// emails never get in, admins always do and anyone else not allowed waits
+// for an admin's approval if approve-signups is on.
+func checkAccess(rc redis.Conn, email string) (int, error) {
+	if email == "" {
+		return accessDenied, nil
+	}
+
+	allow, deny, err := accessRules(rc)
+	if err != nil {
+		return accessDenied, err
+	}
+
+	switch {
+	case matchAny(deny, email):
+		return accessDenied, nil
+	case matchAny(allow, email) || isAdmin(email):
+		return accessAllowed, nil
+	case !*approveSignups:
+		return accessDenied, nil
+	}
+
+	_, err = rc.Do("ZADD", key("access", "pending"), "NX",
+		time.Now().UTC().Unix(), strings.ToLower(email))
+	return accessPending, err
+}
+
+// renderNoAccess tells someone who can't log in why.
+func renderNoAccess(w http.ResponseWriter, req *http.Request, access int, email string) {
+	renderAccount(w, req, http.StatusForbidden, "waiting", map[string]interface{}{
+		"Email":   email,
+		"Pending": access == accessPending,
+	})
+}
+
+// Middlewares
+
+func requireLogin(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		session := c.Env["session"].(*sessions.Session)
+
+		uid, loggedIn := session.Values["uid"]
+
+		if !loggedIn {
+			http.Redirect(w, req, loginRedirect(), http.StatusFound)
+			return
+		}
+
+		c.Env["uid"] = uid
+
+		h.ServeHTTP(w, req)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func requireAPILogin(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		session := c.Env["session"].(*sessions.Session)
+
+		uid, loggedIn := session.Values["uid"]
+
+		if !loggedIn {
+			r.JSON(w, http.StatusUnauthorized, map[string]string{
+				"Error": "Login required",
+			})
+			return
+		}
+
+		c.Env["uid"] = uid
+
+		h.ServeHTTP(w, req)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// formAccess returns the form in the URL and the role uid has on it. The
+// form is empty if it doesn't exist.
+func formAccess(c web.C) (Form, string, error) {
+	var form Form
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	err := getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil || form == (Form{}) {
+		return form, "", err
+	}
+	role, err := formRole(rc, form, c.Env["uid"].(string))
+	return form, role, err
+}
+
+// requireRole only lets people with at least role on the form in the URL
+// through to h. Their role is put in c.Env["role"].
+func requireRole(role string, h func(web.C, http.ResponseWriter, *http.Request)) func(web.C, http.ResponseWriter, *http.Request) {
+	return func(c web.C, w http.ResponseWriter, req *http.Request) {
+		form, has, err := formAccess(c)
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case form == (Form{}):
+			http.Error(w, "Form doesn't exist", http.StatusNotFound)
+		case !can(has, role):
+			http.Error(w, translate(getLanguage(c), "You don't have access to do that"), http.StatusForbidden)
+		default:
+			c.Env["role"] = has
+			h(c, w, req)
+		}
+	}
+}
+
+func requireAPIRole(role string, h func(web.C, http.ResponseWriter, *http.Request)) func(web.C, http.ResponseWriter, *http.Request) {
+	return func(c web.C, w http.ResponseWriter, req *http.Request) {
+		form, has, err := formAccess(c)
+		switch {
+		case err != nil:
+			apiError(w, http.StatusInternalServerError, err)
+		case form == (Form{}):
+			apiError(w, http.StatusNotFound, errors.New("Form doesn't exist"))
+		case !can(has, role):
+			apiError(w, http.StatusForbidden, errors.New("You don't have access to do that"))
+		default:
+			c.Env["role"] = has
+			h(c, w, req)
+		}
+	}
+}
+
+// requireAdmin only lets admins through to h.
+func requireAdmin(h func(web.C, http.ResponseWriter, *http.Request)) func(web.C, http.ResponseWriter, *http.Request) {
+	return func(c web.C, w http.ResponseWriter, req *http.Request) {
+		rc := rp.Get()
+		email := userEmail(rc, c.Env["uid"].(string))
+		rc.Close()
+
+		if !isAdmin(email) {
+			http.Error(w, translate(getLanguage(c), "Only admins can do that"), http.StatusForbidden)
+			return
+		}
+		h(c, w, req)
+	}
+}
+
+func sessionEnv(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		session, err := rs.Get(req, "session")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.Env["session"] = session
+
+		var preferred string
+		if uid, ok := session.Values["uid"].(string); ok {
+			rc := rp.Get()
+			preferred, _ = redis.String(rc.Do(
+				"HGET", key(uid, "settings"), "Language",
+			))
+			rc.Close()
+		}
+		c.Env["lang"] = negotiateLanguage(req, preferred)
+
+		h.ServeHTTP(w, req)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Index
+
+func index(c web.C, w http.ResponseWriter, req *http.Request) {
+	var loggedIn bool
+	if session, err := rs.Get(req, "session"); err == nil {
+		_, loggedIn = session.Values["uid"]
+	}
+
+	r.HTML(w, http.StatusOK, "index", map[string]interface{}{
+		"Lang":          negotiateLanguage(req, ""),
+		"LoggedIn":      loggedIn,
+		"Providers":     enabledProviders(),
+		"LocalAccounts": *localAccounts,
+		"LocalSignup":   *localAccounts && *localSignup,
+	})
+}
+
+// Login
+
+// startLogin sends people to log in with the provider they picked. The
+// provider and a random state are kept in the session to check when they
+// come back.
+func startLogin(c web.C, w http.ResponseWriter, req *http.Request) {
+	p := findProvider(c.URLParams["provider"])
+	if p == nil {
+		http.Error(w, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+
+	lc, err := loginConfig(req, p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	session, err := rs.Get(req, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	state := genToken()
+	session.Values["provider"] = p.Name
+	session.Values["state"] = state
+	if err := session.Save(req, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, req, lc.AuthCodeURL(state), http.StatusFound)
+}
+
+func login(c web.C, w http.ResponseWriter, req *http.Request) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}()
+
+	session, err := rs.Get(req, "session")
+	if err != nil {
+		return
+	}
+	state, _ := session.Values["state"].(string)
+	name, _ := session.Values["provider"].(string)
+	delete(session.Values, "state")
+	delete(session.Values, "provider")
+
+	code := req.URL.Query().Get("code")
+	if code == "" || !checkState(state, req.URL.Query().Get("state")) {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	p := findProvider(name)
+	if p == nil {
+		http.Error(w, "Unknown login provider", http.StatusForbidden)
+		return
+	}
+
+	lc, err := loginConfig(req, p)
+	if err != nil {
+		return
+	}
+
+	tok, err := lc.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		return
+	}
+
+	user, err := p.User(lc.Client(oauth2.NoContext, tok))
+	if err != nil {
+		return
+	}
+
+	uid := loginUID(p.Name, user.ID)
+	if uid == "" {
+		http.Error(w, "The login provider didn't say who you are", http.StatusBadGateway)
+		return
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	access, err := checkAccess(rc, user.Email)
+	if err != nil {
+		return
+	}
+	if access != accessAllowed {
+		err = session.Save(req, w)
+		if err != nil {
+			return
+		}
+		renderNoAccess(w, req, access, user.Email)
+		return
+	}
+
+	err = startSession(rc, w, req, session, uid, p.Name, user)
+}
+
+// checkState reports whether the state a provider sent back is the one
+// startLogin kept in the session.
+func checkState(want string, got string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1
+}
+
+// loginUID is the user ID of someone a provider knows as id. Google users
+// keep their unprefixed IDs from before there were other providers. It's
+// empty if the provider didn't give an ID.
+func loginUID(provider string, id string) string {
+	switch {
+	case id == "":
+		return ""
+	case provider == "google":
+		return id
+	}
+	return provider + ":" + id
+}
+
+// startSession logs someone in and sends them to the dashboard.
+func startSession(rc redis.Conn, w http.ResponseWriter, req *http.Request, session *sessions.Session, uid string, provider string, user User) error {
+	rc.Do("HMSET", key(uid, "profile"),
+		"Provider", provider,
+		"Email", user.Email,
+		"Name", user.Name,
+	)
+
+	session.Values["uid"] = uid
+	if err := session.Save(req, w); err != nil {
+		return err
+	}
+
+	http.Redirect(w, req, "/dashboard/", http.StatusFound)
+	return nil
+}
+
+// Accounts
+
+// Account is someone who logs in with an email and password instead of a
+// provider. Their user ID is "local:" followed by the account's ID. They
+// can't log in until they've followed the link emailed to confirm it.
+type Account struct {
+	ID        string
+	Email     string
+	Name      string
+	Password  string
+	Created   int64
+	Confirmed bool
+}
+
+// A made up hash to check passwords against when there's no account so
+// logging in takes as long whether there is one or not
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("formic"), bcrypt.DefaultCost)
+
+func getAccount(rc redis.Conn, email string, account *Account) error {
+	v, err := redis.Values(rc.Do(
+		"HGETALL", key("account", strings.ToLower(strings.TrimSpace(email))),
+	))
+	if err != nil {
+		return err
+	}
+	return redis.ScanStruct(v, account)
+}
+
+func checkPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errorf("Passwords need at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return errorf("Passwords can't be longer than %d bytes", maxPasswordLength)
+	}
+	return nil
+}
+
+func setPassword(rc redis.Conn, email string, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = rc.Do("HSET", key("account", strings.ToLower(email)), "Password", string(hash))
+	return err
+}
+
+// sendMail sends a plain text email through the configured SMTP server, or
+// logs it if there isn't one.
+func sendMail(to string, subject string, body string) error {
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		*smtpFrom, to, mime.QEncoding.Encode("utf-8", subject), body,
+	)
+	if *smtpHost == "" {
+		log.Printf("No SMTP server configured, not sending:\n%s", msg)
+		return nil
+	}
+
+	var auth smtp.Auth
+	if *smtpUsername != "" {
+		auth = smtp.PlainAuth("", *smtpUsername, *smtpPassword, *smtpHost)
+	}
+	return smtp.SendMail(
+		fmt.Sprintf("%s:%d", *smtpHost, *smtpPort),
+		auth, *smtpFrom, []string{to}, []byte(msg),
+	)
+}
+
+// sendConfirmation emails account a link to confirm its email address with,
+// unless one was sent less than confirmResendInterval ago so failed logins
+// can't be used to flood its inbox.
+func sendConfirmation(rc redis.Conn, account Account, lang string) error {
+	_, err := redis.String(rc.Do(
+		"SET", key("account", strings.ToLower(account.Email), "confirmSent"), 1,
+		"EX", int64(confirmResendInterval/time.Second), "NX",
+	))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only a hash of the token is kept in case the database leaks
+	token := genToken()
+	sum := sha256.Sum256([]byte(token))
+	_, err = rc.Do("SET", key("confirm", hex.EncodeToString(sum[:])), account.Email,
+		"EX", int64(confirmTTL/time.Second))
+	if err != nil {
+		return err
+	}
+
+	body := translate(
+		lang, "Open this link within a day to confirm your email address and finish signing up for Formic:\n\n%s\n\nIf it wasn't you, you can ignore this email.",
+		emailURL("/confirm/"+token),
+	)
+	return sendMail(account.Email, translate(lang, "Confirm your email for Formic"), body)
+}
+
+// requireLocalAccounts only lets requests through to account pages if
+// local accounts are turned on.
+func requireLocalAccounts(h func(web.C, http.ResponseWriter, *http.Request)) func(web.C, http.ResponseWriter, *http.Request) {
+	return func(c web.C, w http.ResponseWriter, req *http.Request) {
+		if !*localAccounts {
+			http.NotFound(w, req)
+			return
+		}
+		h(c, w, req)
+	}
+}
+
+func renderAccount(w http.ResponseWriter, req *http.Request, status int, name string, binding map[string]interface{}) {
+	binding["Lang"] = negotiateLanguage(req, "")
+	binding["LocalSignup"] = *localSignup
+	if err, ok := binding["Error"].(error); ok {
+		binding["Error"] = translateError(binding["Lang"].(string), err)
+	}
+	r.HTML(w, status, name, binding)
+}
+
+func showLogin(c web.C, w http.ResponseWriter, req *http.Request) {
+	renderAccount(w, req, http.StatusOK, "login", map[string]interface{}{})
+}
+
+func localLogin(c web.C, w http.ResponseWriter, req *http.Request) {
+	var account Account
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	email := strings.TrimSpace(req.FormValue("email"))
+	password := req.FormValue("password")
+
+	if err := getAccount(rc, email, &account); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hash := []byte(account.Password)
+	if account.ID == "" {
+		hash = dummyHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || account.ID == "" {
+		renderAccount(w, req, http.StatusForbidden, "login", map[string]interface{}{
+			"Email": email,
+			"Error": errorf("Wrong email or password"),
+		})
+		return
+	}
+
+	if !account.Confirmed {
+		err := sendConfirmation(rc, account, negotiateLanguage(req, ""))
+		if err != nil {
+			log.Printf("Couldn't send confirmation email: %s", err)
+		}
+		renderAccount(w, req, http.StatusForbidden, "login", map[string]interface{}{
+			"Email": email,
+			"Error": errorf("Confirm your email address with the link we emailed you before logging in."),
+		})
+		return
+	}
+
+	access, err := checkAccess(rc, account.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if access != accessAllowed {
+		renderNoAccess(w, req, access, account.Email)
+		return
+	}
+
+	session, err := rs.Get(req, "session")
+	if err == nil {
+		err = startSession(rc, w, req, session, "local:"+account.ID, "local", User{
+			ID:    account.ID,
+			Email: account.Email,
+			Name:  account.Name,
+		})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func showSignup(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !*localSignup {
+		http.NotFound(w, req)
+		return
+	}
+	renderAccount(w, req, http.StatusOK, "signup", map[string]interface{}{})
+}
+
+func signup(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		account Account
+		err     error
+	)
+
+	if !*localSignup {
+		http.NotFound(w, req)
+		return
+	}
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	name := strings.TrimSpace(req.FormValue("name"))
+	email := strings.TrimSpace(req.FormValue("email"))
+	password := req.FormValue("password")
+
+	defer func() {
+		if _, ok := err.(userError); ok {
+			renderAccount(w, req, http.StatusBadRequest, "signup", map[string]interface{}{
+				"Name":  name,
+				"Email": email,
+				"Error": err,
+			})
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}()
+
+	if !strings.Contains(email, "@") {
+		err = errorf("Enter a valid email address")
+		return
+	}
+	if err = checkPassword(password); err != nil {
+		return
+	}
+	if password != req.FormValue("confirm") {
+		err = errorf("Passwords don't match")
+		return
+	}
+
+	// Whether they're allowed in is only decided once they've confirmed
+	// their email, but those who never will be can be told now
+	_, deny, err := accessRules(rc)
+	if err != nil {
+		return
+	}
+	if matchAny(deny, email) {
+		err = errorf("%s isn't allowed to sign up", email)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+
+	account = Account{
+		ID:       genID(),
+		Email:    email,
+		Name:     name,
+		Password: string(hash),
+		Created:  time.Now().UTC().Unix(),
+	}
+	k := key("account", strings.ToLower(email))
+	created, err := redis.Int(rc.Do("HSETNX", k, "ID", account.ID))
+	if err != nil {
+		return
+	}
+	if created == 0 {
+		err = errorf("There's already an account for %s", email)
+		return
+	}
+	_, err = rc.Do("HMSET", redis.Args{}.Add(k).AddFlat(&account)...)
+	if err != nil {
+		return
+	}
+
+	if err = sendConfirmation(rc, account, negotiateLanguage(req, "")); err != nil {
+		return
+	}
+
+	renderAccount(w, req, http.StatusOK, "signup", map[string]interface{}{
+		"Email": email,
+		"Sent":  true,
+	})
+}
+
+// confirmEmail confirms the email address of the account a link was sent to,
+// since only its owner could have followed it.
+func confirmEmail(c web.C, w http.ResponseWriter, req *http.Request) {
+	var account Account
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	sum := sha256.Sum256([]byte(c.URLParams["token"]))
+	k := key("confirm", hex.EncodeToString(sum[:]))
+	email, err := redis.String(rc.Do("GET", k))
+	if err == nil {
+		err = getAccount(rc, email, &account)
+	}
+	if err != nil && err != redis.ErrNil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if account.ID == "" {
+		renderAccount(w, req, http.StatusNotFound, "login", map[string]interface{}{
+			"Error": errorf("This confirmation link has expired. Log in to get a new one."),
+		})
+		return
+	}
+
+	_, err = rc.Do("HSET", key("account", strings.ToLower(account.Email)), "Confirmed", true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rc.Do("DEL", k)
+
+	renderAccount(w, req, http.StatusOK, "login", map[string]interface{}{
+		"Email":  account.Email,
+		"Notice": translate(negotiateLanguage(req, ""), "Your email address is confirmed. Log in below."),
+	})
+}
+
+func showForgot(c web.C, w http.ResponseWriter, req *http.Request) {
+	renderAccount(w, req, http.StatusOK, "forgot", map[string]interface{}{})
+}
+
+// forgotPassword emails a password reset link. It says the same thing
+// whether there's an account or not so it can't be used to find them.
+func forgotPassword(c web.C, w http.ResponseWriter, req *http.Request) {
+	var account Account
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	email := strings.TrimSpace(req.FormValue("email"))
+	lang := negotiateLanguage(req, "")
+
+	if err := getAccount(rc, email, &account); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if account.ID != "" {
+		// Only a hash of the token is kept in case the database leaks
+		token := genToken()
+		sum := sha256.Sum256([]byte(token))
+		rc.Do("SET", key("reset", hex.EncodeToString(sum[:])), account.Email,
+			"EX", int64(resetTTL/time.Second))
+
+		body := translate(
+			lang, "Someone asked to reset your Formic password. Open this link within an hour to pick a new one:\n\n%s\n\nIf it wasn't you, you can ignore this email.",
+			emailURL("/reset/"+token),
+		)
+		err := sendMail(account.Email, translate(lang, "Reset your Formic password"), body)
+		if err != nil {
+			log.Printf("Couldn't send password reset email: %s", err)
+		}
+	}
+
+	renderAccount(w, req, http.StatusOK, "forgot", map[string]interface{}{
+		"Sent": true,
+	})
+}
+
+func resetEmail(rc redis.Conn, token string) (string, error) {
+	sum := sha256.Sum256([]byte(token))
+	email, err := redis.String(rc.Do("GET", key("reset", hex.EncodeToString(sum[:]))))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return email, err
+}
+
+func showReset(c web.C, w http.ResponseWriter, req *http.Request) {
+	rc := rp.Get()
+	defer rc.Close()
+
+	email, err := resetEmail(rc, c.URLParams["token"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderAccount(w, req, http.StatusOK, "reset", map[string]interface{}{
+		"Email": email,
+	})
+}
+
+func resetPassword(c web.C, w http.ResponseWriter, req *http.Request) {
+	var err error
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	email, err := resetEmail(rc, c.URLParams["token"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if _, ok := err.(userError); ok {
+			renderAccount(w, req, http.StatusBadRequest, "reset", map[string]interface{}{
+				"Email": email,
+				"Error": err,
+			})
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}()
+
+	if email == "" {
+		err = errorf("This password reset link has expired")
+		return
+	}
+
+	password := req.FormValue("password")
+	if err = checkPassword(password); err != nil {
+		return
+	}
+	if password != req.FormValue("confirm") {
+		err = errorf("Passwords don't match")
+		return
+	}
+
+	if err = setPassword(rc, email, password); err != nil {
+		return
+	}
+	// Only the email's owner gets reset links, so this confirms it too
+	rc.Do("HSET", key("account", strings.ToLower(email)), "Confirmed", true)
+	sum := sha256.Sum256([]byte(c.URLParams["token"]))
+	rc.Do("DEL", key("reset", hex.EncodeToString(sum[:])))
+
+	renderAccount(w, req, http.StatusOK, "login", map[string]interface{}{
+		"Email":  email,
+		"Notice": translate(negotiateLanguage(req, ""), "Your password has been changed. Log in with it below."),
+	})
+}
 
 func logout(c web.C, w http.ResponseWriter, req *http.Request) {
 	var err error
 
 	defer func() {
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}()
+
+	session, err := rs.Get(req, "session")
+	if err != nil {
+		return
+	}
+
+	session.Options.MaxAge = -1
+	err = session.Save(req, w)
+	if err != nil {
+		return
+	}
+
+	http.Redirect(w, req, "/", http.StatusFound)
+}
+
+// Dashboard
+
+func showForms(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		forms []Form
+		err   error
+	)
+
+	uid := c.Env["uid"].(string)
+	rc := rp.Get()
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}()
+
+	forms, err = getForms(rc, uid)
+	if err != nil {
+		return
+	}
+	setRole(forms, "owner")
+
+	teams, err := getTeams(rc, uid)
+	if err != nil {
+		return
+	}
+	teamForms := make([][]Form, len(teams))
+	for i, team := range teams {
+		teamForms[i], err = getFormsIn(rc, key("team", team.ID, "forms"))
+		if err != nil {
+			return
+		}
+		setRole(teamForms[i], memberRole(team.Role))
+	}
+
+	shared, err := getSharedForms(rc, uid)
+	if err != nil {
+		return
+	}
+	listed := forms
+	for _, f := range teamForms {
+		listed = append(listed, f...)
+	}
+	shared = unlisted(shared, listed)
+
+	language, err := redis.String(rc.Do("HGET", key(uid, "settings"), "Language"))
+	if err != nil && err != redis.ErrNil {
+		return
+	}
+	err = nil
+
+	r.HTML(w, http.StatusOK, "forms", map[string]interface{}{
+		"Forms":     forms,
+		"Teams":     teams,
+		"TeamForms": teamForms,
+		"Shared":    shared,
+		"Admin":     isAdmin(userEmail(rc, uid)),
+		"Messages":  getMessages(c, w, req),
+		"Lang":      getLanguage(c),
+		"Language":  language,
+		"Languages": languages,
+	})
+}
+
+func createForm(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		formName    string
+		redirectURL string
+		team        string
+		err         error
+	)
+
+	session := c.Env["session"].(*sessions.Session)
+	uid := c.Env["uid"].(string)
+	rc := rp.Get()
+
+	defer func() {
+		if err != nil {
+			session.AddFlash(translateError(getLanguage(c), err), "warning")
+			session.Save(req, w)
+			showForms(c, w, req)
+			return
+		}
+
+		id := genID()
+
+		rc.Do("HMSET", key("form", id),
+			"ID", id,
+			"Name", formName,
+			"RedirectURL", redirectURL,
+			"Team", team,
+			"Owner", uid,
+		)
+
+		rc.Do("SADD", key(formOwner(uid, team), "forms"), id)
+		audit(rc, c, req, "form.create", id, formName)
+
+		session.AddFlash(translate(getLanguage(c), "Form created"), "success")
+		session.Save(req, w)
+
+		url := fmt.Sprintf("/dashboard/%s", id)
+		http.Redirect(w, req, url, http.StatusFound)
+	}()
+
+	if err = req.ParseForm(); err != nil {
+		return
+	}
+
+	formName = req.PostForm.Get("formName")
+	if formName == "" {
+		err = errorf("Form name can't be empty")
+		return
+	}
+
+	redirectURL = req.PostForm.Get("redirectURL")
+	if redirectURL != "" {
+		if err = checkRedirect(redirectURL); err != nil {
+			return
+		}
+	}
+
+	team = req.PostForm.Get("team")
+	if team != "" {
+		var role string
+		role, err = teamRole(rc, team, uid)
+		if err == nil && role == "" {
+			err = errorf("You're not in that workspace")
+		}
+	}
+}
+
+func showForm(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		form    Form
+		entries []Entry
+		err     error
+	)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}()
+
+	err = getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		return
+	}
+
+	if form == (Form{}) {
+		http.Error(w, "Form doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	filter := req.URL.Query().Get("filter")
+	label := req.URL.Query().Get("label")
+
+	formURL := createURL(req)
+	formURL.Path = fmt.Sprintf("/s/%s", form.ID)
+
+	viewURL := formURL
+	viewURL.Path = fmt.Sprintf("/v/%s", form.ID)
+
+	hostedURL := formURL
+	hostedURL.Path = fmt.Sprintf("/f/%s", form.ID)
+
+	embedURL := formURL
+	embedURL.Path = fmt.Sprintf("/embed/%s.js", form.ID)
+
+	def, err := parseDefinition(form.Definition)
+	if err != nil {
+		return
+	}
+
+	fields, err := redis.Strings(rc.Do(
+		"SMEMBERS",
+		key("form", form.ID, "fields"),
+	))
+	if err != nil {
+		return
+	}
+
+	entries, err = getEntries(rc, form.ID, filter, label)
+	if err != nil {
+		return
+	}
+
+	labels, err := redis.Strings(rc.Do(
+		"SMEMBERS",
+		key("form", form.ID, "labels"),
+	))
+	if err != nil {
+		return
+	}
+	sort.Strings(labels)
+
+	views, err := redis.Int64(rc.Do("GET", key("form", form.ID, "views")))
+	if err != nil && err != redis.ErrNil {
+		return
+	}
+	submissions, err := redis.Int64(rc.Do("ZCARD", key("form", form.ID, "entries")))
+	if err != nil {
+		return
+	}
+	inProgress, err := redis.Int64(rc.Do(
+		"ZCOUNT", key("form", form.ID, "partials"),
+		time.Now().UTC().Add(-partialTTL).Unix(), "+inf",
+	))
+	if err != nil {
+		return
+	}
+	// Fields that can be made unique include the hosted form's, even
+	// before anyone's filled them in
+	uniqueChoices := append([]string{}, fields...)
+	for _, field := range def.Fields {
+		if field.Type != "page" && !contains(uniqueChoices, field.Name) {
+			uniqueChoices = append(uniqueChoices, field.Name)
+		}
+	}
+	sort.Strings(uniqueChoices)
+
+	closed, err := formClosed(rc, form, getLanguage(c))
+	if err != nil {
+		return
+	}
+	// Only submissions made since views started being counted convert
+	// them, and visitors who submit without being counted can't push the
+	// rate past 100%
+	var conversion int64
+	if views > 0 {
+		var since int64
+		converted := submissions
+		since, err = redis.Int64(rc.Do("GET", key("form", form.ID, "viewsSince")))
+		if err == nil {
+			converted, err = redis.Int64(rc.Do(
+				"ZCOUNT", key("form", form.ID, "entries"), since, "+inf",
+			))
+		}
+		if err != nil && err != redis.ErrNil {
+			return
+		}
+		err = nil
+		conversion = converted * 100 / views
+		if conversion > 100 {
+			conversion = 100
+		}
+	}
+
+	teams, err := getTeams(rc, c.Env["uid"].(string))
+	if err != nil {
+		return
+	}
+
+	role := c.Env["role"].(string)
+	var grants []Grant
+	if can(role, "owner") {
+		grants, err = getGrants(rc, form.ID)
+		if err != nil {
+			return
+		}
+	}
+
+	r.HTML(w, http.StatusOK, "form", map[string]interface{}{
+		"Form":          form,
+		"Role":          role,
+		"Roles":         formRoles,
+		"Grants":        grants,
+		"Teams":         teams,
+		"FormURL":       formURL.String(),
+		"ViewURL":       viewURL.String(),
+		"HostedURL":     hostedURL.String(),
+		"EmbedURL":      embedURL.String(),
+		"Snippet":       formSnippet(formURL.String(), def),
+		"Views":         views,
+		"Submissions":   submissions,
+		"Conversion":    conversion,
+		"InProgress":    inProgress,
+		"Closed":        closed,
+		"Fields":        fields,
+		"UniqueChoices": uniqueChoices,
+		"Unique":        uniqueFields(form),
+		"Entries":       entries,
+		"Labels":        labels,
+		"Filter":        filter,
+		"Label":         label,
+		"Messages":      getMessages(c, w, req),
+		"Lang":          getLanguage(c),
+		"Languages":     languages,
+	})
+}
+
+func updateForm(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		formName     string
+		redirectURL  string
+		failureURL   string
+		language     string
+		opensAt      int64
+		closesAt     int64
+		maxEntries   int64
+		unique       []string
+		uniqueAction string
+		err          error
+	)
+
+	session := c.Env["session"].(*sessions.Session)
+	rc := rp.Get()
+
+	defer func() {
+		if err != nil {
+			session.AddFlash(translateError(getLanguage(c), err), "warning")
+			session.Save(req, w)
+			showForm(c, w, req)
+			return
+		}
+
+		// Entries are looked up by the unique fields' values so the index
+		// has to be rebuilt when they change
+		oldUnique, _ := redis.String(rc.Do("HGET", key("form", c.URLParams["id"]), "UniqueFields"))
+
+		rc.Do("HMSET", key("form", c.URLParams["id"]),
+			"Name", formName,
+			"RedirectURL", redirectURL,
+			"FailureURL", failureURL,
+			"ThankYou", req.PostForm.Get("thankYou"),
+			"IgnoreIP", req.PostForm.Get("captureIP") == "",
+			"IgnoreUserAgent", req.PostForm.Get("captureUserAgent") == "",
+			"IgnoreReferrer", req.PostForm.Get("captureReferrer") == "",
+			"IgnoreUTM", req.PostForm.Get("captureUTM") == "",
+			"Language", language,
+			"Disabled", req.PostForm.Get("accepting") == "",
+			"OpensAt", opensAt,
+			"ClosesAt", closesAt,
+			"MaxEntries", maxEntries,
+			"ClosedMessage", req.PostForm.Get("closedMessage"),
+			"UniqueFields", strings.Join(unique, ","),
+			"UniqueAction", uniqueAction,
+			"LockFields", req.PostForm.Get("lockFields") != "",
+		)
+
+		if strings.Join(unique, ",") != oldUnique {
+			indexUnique(rc, Form{
+				ID:           c.URLParams["id"],
+				UniqueFields: strings.Join(unique, ","),
+			})
+		}
+
+		audit(rc, c, req, "form.update", c.URLParams["id"], formName)
+
+		session.AddFlash(translate(getLanguage(c), "Form updated"), "info")
+		session.Save(req, w)
+		showForm(c, w, req)
+	}()
+
+	if err = req.ParseForm(); err != nil {
+		return
+	}
+
+	formName = req.PostForm.Get("formName")
+	if formName == "" {
+		err = errorf("Form name can't be empty")
+		return
+	}
+
+	redirectURL = req.PostForm.Get("redirectURL")
+	if redirectURL != "" {
+		if err = checkRedirect(redirectURL); err != nil {
+			return
+		}
+	}
+
+	failureURL = req.PostForm.Get("failureURL")
+	if failureURL != "" {
+		if err = checkRedirect(failureURL); err != nil {
+			return
+		}
+	}
+
+	// Hosted pages follow the browser's language unless one is picked
+	language = req.PostForm.Get("language")
+	if language != "" && !knownLanguage(language) {
+		err = errorf("Unknown language: %s", language)
+		return
+	}
+
+	if opensAt, err = parseSchedule(req.PostForm.Get("opensAt")); err != nil {
+		return
+	}
+	if closesAt, err = parseSchedule(req.PostForm.Get("closesAt")); err != nil {
+		return
+	}
+	if opensAt > 0 && closesAt > 0 && closesAt <= opensAt {
+		err = errorf("Forms have to open before they close")
+		return
+	}
+
+	if max := req.PostForm.Get("maxEntries"); max != "" {
+		maxEntries, err = strconv.ParseInt(max, 10, 64)
+		if err != nil || maxEntries < 0 {
+			err = errorf("Maximum entries has to be a positive number")
+			return
+		}
+	}
+
+	for _, field := range req.PostForm["uniqueFields"] {
+		if field != "" && !strings.Contains(field, ",") && !contains(unique, field) {
+			unique = append(unique, field)
+		}
+	}
+	sort.Strings(unique)
+	uniqueAction = req.PostForm.Get("uniqueAction")
+	if len(unique) > 0 && !contains(uniqueActions, uniqueAction) {
+		err = errorf("Unknown duplicate action: %s", uniqueAction)
+		return
+	}
+}
+
+func updateLanguage(c web.C, w http.ResponseWriter, req *http.Request) {
+	uid := c.Env["uid"].(string)
+	rc := rp.Get()
+	defer rc.Close()
+
+	language := req.FormValue("language")
+	if language == "" || knownLanguage(language) {
+		rc.Do("HSET", key(uid, "settings"), "Language", language)
+	}
+
+	// Go back to the dashboard page the language was picked on
+	back := "/dashboard/"
+	if ref, err := url.Parse(req.Referer()); err == nil &&
+		strings.HasPrefix(ref.Path, "/dashboard/") {
+		back = ref.RequestURI()
+	}
+	http.Redirect(w, req, back, http.StatusFound)
+}
+
+func deleteForm(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		form Form
+		err  error
+	)
+
+	session := c.Env["session"].(*sessions.Session)
+	uid := c.Env["uid"].(string)
+	rc := rp.Get()
+
+	defer func() {
+		if err != nil {
+			session.AddFlash(translateError(getLanguage(c), err), "warning")
+			session.Save(req, w)
+			return
+		}
+		audit(rc, c, req, "form.delete", c.URLParams["id"], form.Name)
+
+		session.AddFlash(translate(getLanguage(c), "Form deleted"), "success")
+		session.Save(req, w)
+	}()
+
+	fid := c.URLParams["id"]
+	err = getForm(rc, key("form", fid), &form)
+	if err != nil {
+		return
+	}
+	owner := formOwner(form.Owner, form.Team)
+	if form.Owner == "" && form.Team == "" {
+		// Forms created before they had owners are only in their creator's
+		// forms, and owners by grant aren't them
+		var created bool
+		created, err = redis.Bool(rc.Do("SISMEMBER", key(uid, "forms"), fid))
+		if err != nil {
+			return
+		}
+		if !created {
+			err = errorf("Only the person who created this form can delete it")
+			return
+		}
+		owner = uid
+	}
+
+	_, err = rc.Do("SADD", key(owner, "deletedForms"), fid)
+	if err != nil {
+		return
+	}
+
+	_, err = rc.Do("SREM", key(owner, "forms"), fid)
+	if err != nil {
+		return
+	}
+
+	emails, err := redis.Strings(rc.Do("HKEYS", key("form", fid, "roles")))
+	if err != nil {
+		return
+	}
+	for _, email := range emails {
+		rc.Do("SREM", key("shared", email), fid)
+	}
+
+	// Nobody keeps access to deleted forms through their owner, workspace
+	// or what they were shared with
+	rc.Send("MULTI")
+	rc.Send("DEL", key("form", fid, "roles"))
+	rc.Send("HDEL", key("form", fid), "Owner", "Team")
+	_, err = rc.Do("EXEC")
+}
+
+// moveForm moves a form into one of someone's workspaces or out of them.
+func moveForm(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		form Form
+		err  error
+	)
+
+	session := c.Env["session"].(*sessions.Session)
+	uid := c.Env["uid"].(string)
+	fid := c.URLParams["id"]
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			session.AddFlash(translateError(getLanguage(c), err), "warning")
+		} else {
+			session.AddFlash(translate(getLanguage(c), "Form moved"), "success")
+		}
+		session.Save(req, w)
+		http.Redirect(w, req, "/dashboard/"+fid, http.StatusFound)
+	}()
+
+	err = getForm(rc, key("form", fid), &form)
+	if err != nil {
+		return
+	}
+
+	from := formOwner(uid, form.Team)
+	in, err := redis.Bool(rc.Do("SISMEMBER", key(from, "forms"), fid))
+	if err != nil {
+		return
+	}
+	if in && form.Team != "" {
+		var role string
+		role, err = teamRole(rc, form.Team, uid)
+		in = role != ""
+	}
+	if err != nil {
+		return
+	}
+	if !in {
+		err = errorf("You can only move your own forms")
+		return
+	}
+
+	team := req.FormValue("team")
+	if team != "" {
+		var role string
+		role, err = teamRole(rc, team, uid)
+		if err != nil {
+			return
+		}
+		if role == "" {
+			err = errorf("You're not in that workspace")
+			return
+		}
+	}
+
+	rc.Send("MULTI")
+	rc.Send("SMOVE", key(from, "forms"), key(formOwner(uid, team), "forms"), fid)
+	rc.Send("HSET", key("form", fid), "Team", team)
+	// Forms taken out of a workspace belong to whoever took them
+	if team == "" {
+		rc.Send("HSET", key("form", fid), "Owner", uid)
+	}
+	_, err = rc.Do("EXEC")
+	if err == nil {
+		audit(rc, c, req, "form.move", fid, team)
+	}
+}
+
+func showEntry(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		form  Form
+		entry Entry
+		err   error
+	)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}()
+
+	err = getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		return
+	}
+
+	if form == (Form{}) {
+		http.Error(w, "Form doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	rank, err := rc.Do(
+		"ZREVRANK",
+		key("form", form.ID, "entries"),
+		c.URLParams["eid"],
+	)
+	if err != nil {
+		return
+	}
+	if rank == nil {
+		http.Error(w, "Entry doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	err = markEntry(rc, form.ID, c.URLParams["eid"], "unread", false)
+	if err != nil {
+		return
+	}
+
+	err = getEntry(rc, form.ID, c.URLParams["eid"], &entry)
+	if err != nil {
+		return
+	}
+
+	comments, err := getComments(rc, form.ID, entry.ID)
+	if err != nil {
+		return
+	}
+
+	versions, err := getVersions(rc, form.ID, entry.ID)
+	if err != nil {
+		return
+	}
+
+	// Entries are listed newest first so the previous entry is the one
+	// submitted right after this one
+	pos, err := redis.Int64(rank, nil)
+	if err != nil {
+		return
+	}
+	var prev, next string
+	if pos > 0 {
+		prev, err = entryAt(rc, form.ID, pos-1)
+		if err != nil {
+			return
+		}
+	}
+	next, err = entryAt(rc, form.ID, pos+1)
+	if err != nil {
+		return
+	}
+
+	r.HTML(w, http.StatusOK, "entry", map[string]interface{}{
+		"Form":     form,
+		"Role":     c.Env["role"],
+		"Entry":    entry,
+		"Comments": comments,
+		"Versions": versions,
+		"UID":      c.Env["uid"],
+		"Previous": prev,
+		"Next":     next,
+		"Messages": getMessages(c, w, req),
+		"Lang":     getLanguage(c),
+	})
+}
+
+func showEntryJSON(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		entry Entry
+		err   error
+	)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}()
+
+	exists, err := entryExists(rc, c.URLParams["id"], c.URLParams["eid"])
+	if err != nil {
+		return
+	}
+	if !exists {
+		http.Error(w, "Entry doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	err = getEntry(rc, c.URLParams["id"], c.URLParams["eid"], &entry)
+	if err != nil {
+		return
+	}
+
+	r.JSON(w, http.StatusOK, entry)
+}
+
+func updateEntry(c web.C, w http.ResponseWriter, req *http.Request) {
+	var err error
+
+	session := c.Env["session"].(*sessions.Session)
+	fid := c.URLParams["id"]
+	eid := c.URLParams["eid"]
+	rc := rp.Get()
+	defer rc.Close()
+
+	url := fmt.Sprintf("/dashboard/%s/entries/%s", fid, eid)
+
+	defer func() {
+		if err != nil {
+			session.AddFlash(translateError(getLanguage(c), err), "warning")
+			session.Save(req, w)
+			http.Redirect(w, req, url, http.StatusFound)
+			return
+		}
+		audit(rc, c, req, "entry.update", fid+"/"+eid, "")
+
+		session.AddFlash(translate(getLanguage(c), "Entry updated"), "info")
+		session.Save(req, w)
+		http.Redirect(w, req, url, http.StatusFound)
+	}()
+
+	if err = req.ParseForm(); err != nil {
+		return
+	}
+
+	if v, ok := req.PostForm["starred"]; ok {
+		err = markEntry(rc, fid, eid, "starred", v[0] == "1")
+		if err != nil {
+			return
+		}
+	}
+
+	if v, ok := req.PostForm["unread"]; ok {
+		err = markEntry(rc, fid, eid, "unread", v[0] == "1")
+		if err != nil {
+			return
+		}
+		// Viewing the entry again would mark it as read
+		if v[0] == "1" {
+			url = fmt.Sprintf("/dashboard/%s", fid)
+		}
+	}
+
+	if v, ok := req.PostForm["labels"]; ok {
+		err = setEntryLabels(rc, fid, eid, parseLabels(v[0]))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func showBuilder(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		form Form
+		err  error
+	)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}()
+
+	err = getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		return
+	}
+
+	if form == (Form{}) {
+		http.Error(w, "Form doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	def, err := parseDefinition(form.Definition)
+	if err != nil {
+		return
+	}
+
+	r.HTML(w, http.StatusOK, "builder", map[string]interface{}{
+		"Form":       form,
+		"Definition": def,
+		"FieldTypes": fieldTypes,
+		"Messages":   getMessages(c, w, req),
+		"Lang":       getLanguage(c),
+	})
+}
+
+func updateDefinition(c web.C, w http.ResponseWriter, req *http.Request) {
+	var form Form
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	err := getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if form == (Form{}) {
+		apiError(w, http.StatusNotFound, errors.New("Form doesn't exist"))
+		return
+	}
+
+	if err = req.ParseForm(); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	def, err := parseDefinition(req.PostForm.Get("definition"))
+	if err != nil {
+		apiError(
+			w, http.StatusBadRequest,
+			errors.New(translateError(getLanguage(c), err)),
+		)
+		return
+	}
+
+	_, err = rc.Do(
+		"HSET",
+		key("form", form.ID),
+		"Definition", formatDefinition(def),
+	)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	audit(rc, c, req, "form.builder", form.ID, "")
+
+	r.JSON(w, http.StatusOK, def)
+}
+
+func showTheme(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		form Form
+		err  error
+	)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}()
+
+	err = getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		return
+	}
+
+	if form == (Form{}) {
+		http.Error(w, "Form doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	r.HTML(w, http.StatusOK, "theme", map[string]interface{}{
+		"Form":     form,
+		"Theme":    findTheme(form.Theme),
+		"Themes":   themes,
+		"Messages": getMessages(c, w, req),
+		"Lang":     getLanguage(c),
+	})
+}
+
+func updateTheme(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		theme      []interface{}
+		removeLogo bool
+		err        error
+	)
+
+	session := c.Env["session"].(*sessions.Session)
+	rc := rp.Get()
+	fid := c.URLParams["id"]
+
+	defer func() {
+		if err != nil {
+			session.AddFlash(translateError(getLanguage(c), err), "warning")
+			session.Save(req, w)
+			rc.Close()
+			showTheme(c, w, req)
+			return
+		}
+
+		rc.Do("HMSET", append([]interface{}{key("form", fid)}, theme...)...)
+		if removeLogo {
+			rc.Do("DEL", key("form", fid, "logo"))
+		}
+		audit(rc, c, req, "form.theme", fid, "")
+		rc.Close()
+
+		session.AddFlash(translate(getLanguage(c), "Theme updated"), "info")
+		session.Save(req, w)
+		showTheme(c, w, req)
+	}()
+
+	if err = req.ParseMultipartForm(maxLogoSize * 2); err != nil &&
+		err != http.ErrNotMultipart {
+		return
+	}
+	err = nil
+
+	name := findTheme(req.FormValue("theme")).Name
+	theme = append(theme, "Theme", name)
+
+	for _, v := range [][2]string{
+		{"ThemeBackground", "background"},
+		{"ThemeColor", "color"},
+		{"ThemeAccent", "accent"},
+		{"ThemeFont", "font"},
+	} {
+		value := strings.TrimSpace(req.FormValue(v[1]))
+		if !cssValue.MatchString(value) {
+			err = errorf("%s isn't a valid CSS value", value)
+			return
+		}
+		theme = append(theme, v[0], value)
+	}
+
+	customCSS := req.FormValue("customCSS")
+	if strings.Contains(customCSS, "<") {
+		err = errorf("Custom CSS can't contain <")
+		return
+	}
+	theme = append(theme, "CustomCSS", customCSS)
+
+	file, _, ferr := req.FormFile("logo")
+	if ferr == http.ErrMissingFile || ferr == http.ErrNotMultipart {
+		if req.FormValue("removeLogo") != "" {
+			removeLogo = true
+			theme = append(theme, "Logo", "")
+		}
+		return
+	}
+	if ferr != nil {
+		err = ferr
+		return
+	}
+	defer file.Close()
+
+	data, ferr := ioutil.ReadAll(io.LimitReader(file, maxLogoSize+1))
+	if ferr != nil {
+		err = ferr
+		return
+	}
+	if len(data) > maxLogoSize {
+		err = errorf("Logos can't be bigger than %dKB", maxLogoSize>>10)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	if !contains(logoTypes, contentType) {
+		err = errorf("Logos have to be PNG, JPEG, GIF or WebP images")
+		return
+	}
+
+	_, err = rc.Do("HMSET", key("form", fid, "logo"),
+		"Type", contentType,
+		"Data", data,
+	)
+	if err != nil {
+		return
+	}
+	// Changes whenever a new logo is uploaded so it isn't cached
+	theme = append(theme, "Logo", genID())
+}
+
+func showStats(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		form Form
+		err  error
+	)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}()
+
+	err = getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		return
+	}
+
+	if form == (Form{}) {
+		http.Error(w, "Form doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	period := req.URL.Query().Get("period")
+	if _, ok := statsPeriods[period]; !ok {
+		period = "day"
+	}
+
+	stats, err := getStats(rc, form, period)
+	if err != nil {
+		return
+	}
+
+	r.HTML(w, http.StatusOK, "stats", map[string]interface{}{
+		"Form":     form,
+		"Role":     c.Env["role"],
+		"Stats":    stats,
+		"Messages": getMessages(c, w, req),
+		"Lang":     getLanguage(c),
+	})
+}
+
+func createComment(c web.C, w http.ResponseWriter, req *http.Request) {
+	var err error
+
+	session := c.Env["session"].(*sessions.Session)
+	uid := c.Env["uid"].(string)
+	fid := c.URLParams["id"]
+	eid := c.URLParams["eid"]
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			session.AddFlash(translateError(getLanguage(c), err), "warning")
+		}
+		session.Save(req, w)
+		url := fmt.Sprintf("/dashboard/%s/entries/%s", fid, eid)
+		http.Redirect(w, req, url, http.StatusFound)
+	}()
+
+	exists, err := entryExists(rc, fid, eid)
+	if err != nil {
+		return
+	}
+	if !exists {
+		err = errorf("Entry doesn't exist")
+		return
+	}
+
+	if err = req.ParseForm(); err != nil {
+		return
+	}
+
+	text := strings.TrimSpace(req.PostForm.Get("text"))
+	if text == "" {
+		err = errorf("Comment can't be empty")
+		return
+	}
+
+	cid := genID()
+	created := time.Now().UTC().Unix()
+
+	_, err = rc.Do("HMSET", key("form", fid, "entry", eid, "comment", cid),
+		"ID", cid,
+		"Author", uid,
+		"Text", text,
+		"Created", created,
+	)
+	if err != nil {
+		return
+	}
+
+	_, err = rc.Do(
+		"ZADD",
+		key("form", fid, "entry", eid, "comments"),
+		created, cid,
+	)
+	if err == nil {
+		audit(rc, c, req, "entry.comment", fid+"/"+eid, cid)
+	}
+}
+
+// API
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	r.JSON(w, status, map[string]string{
+		"Error": err.Error(),
+	})
+}
+
+func apiForms(c web.C, w http.ResponseWriter, req *http.Request) {
+	uid := c.Env["uid"].(string)
+	rc := rp.Get()
+	defer rc.Close()
+
+	forms, err := getForms(rc, uid)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setRole(forms, "owner")
+	teams, err := getTeams(rc, uid)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, team := range teams {
+		teamForms, err := getFormsIn(rc, key("team", team.ID, "forms"))
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		setRole(teamForms, memberRole(team.Role))
+		forms = append(forms, teamForms...)
+	}
+	shared, err := getSharedForms(rc, uid)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	forms = append(forms, unlisted(shared, forms)...)
+	if forms == nil {
+		forms = []Form{}
+	}
+
+	r.JSON(w, http.StatusOK, forms)
+}
+
+func apiEntries(c web.C, w http.ResponseWriter, req *http.Request) {
+	var form Form
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	err := getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if form == (Form{}) {
+		apiError(w, http.StatusNotFound, errors.New("Form doesn't exist"))
+		return
+	}
+
+	entries, err := getEntries(
+		rc,
+		form.ID,
+		req.URL.Query().Get("filter"),
+		req.URL.Query().Get("label"),
+	)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	audit(rc, c, req, "entries.export", form.ID, "api")
+
+	r.JSON(w, http.StatusOK, entries)
+}
+
+func apiStats(c web.C, w http.ResponseWriter, req *http.Request) {
+	var form Form
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	err := getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if form == (Form{}) {
+		apiError(w, http.StatusNotFound, errors.New("Form doesn't exist"))
+		return
+	}
+
+	period := req.URL.Query().Get("period")
+	if period == "" {
+		period = "day"
+	}
+
+	stats, err := getStats(rc, form, period)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	r.JSON(w, http.StatusOK, stats)
+}
+
+func apiEntry(c web.C, w http.ResponseWriter, req *http.Request) {
+	var entry Entry
+
+	fid := c.URLParams["id"]
+	eid := c.URLParams["eid"]
+	rc := rp.Get()
+	defer rc.Close()
+
+	exists, err := entryExists(rc, fid, eid)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		apiError(w, http.StatusNotFound, errors.New("Entry doesn't exist"))
+		return
+	}
+
+	err = getEntry(rc, fid, eid, &entry)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	r.JSON(w, http.StatusOK, entry)
+}
+
+func apiUpdateEntry(c web.C, w http.ResponseWriter, req *http.Request) {
+	var state struct {
+		Unread  *bool
+		Starred *bool
+		Labels  []string
+	}
+
+	fid := c.URLParams["id"]
+	eid := c.URLParams["eid"]
+	rc := rp.Get()
+	defer rc.Close()
+
+	exists, err := entryExists(rc, fid, eid)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		apiError(w, http.StatusNotFound, errors.New("Entry doesn't exist"))
+		return
+	}
+
+	err = json.NewDecoder(req.Body).Decode(&state)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if state.Unread != nil {
+		err = markEntry(rc, fid, eid, "unread", *state.Unread)
+	}
+	if err == nil && state.Starred != nil {
+		err = markEntry(rc, fid, eid, "starred", *state.Starred)
+	}
+	if err == nil && state.Labels != nil {
+		err = setEntryLabels(
+			rc, fid, eid,
+			parseLabels(strings.Join(state.Labels, ",")),
+		)
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	audit(rc, c, req, "entry.update", fid+"/"+eid, "api")
+
+	apiEntry(c, w, req)
+}
+
+// PendingRequest is someone waiting for an admin to let them log in.
+type PendingRequest struct {
+	Email     string
+	Requested int64
+}
+
+func showAccess(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		pending []PendingRequest
+		err     error
+	)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}()
+
+	values, err := redis.Values(rc.Do(
+		"ZRANGE", key("access", "pending"), 0, -1, "WITHSCORES",
+	))
+	if err != nil {
+		return
+	}
+	err = redis.ScanSlice(values, &pending)
+	if err != nil {
+		return
+	}
+
+	allow, err := redis.Strings(rc.Do("SMEMBERS", key("access", "allow")))
+	if err != nil {
+		return
+	}
+	deny, err := redis.Strings(rc.Do("SMEMBERS", key("access", "deny")))
+	if err != nil {
+		return
+	}
+	sort.Strings(allow)
+	sort.Strings(deny)
+
+	configAllow, configDeny, admin := configRules()
+	r.HTML(w, http.StatusOK, "access", map[string]interface{}{
+		"Pending":        pending,
+		"Allow":          allow,
+		"Deny":           deny,
+		"ConfigAllow":    configAllow,
+		"ConfigDeny":     configDeny,
+		"Admins":         admin,
+		"ApproveSignups": *approveSignups,
+		"Messages":       getMessages(c, w, req),
+		"Lang":           getLanguage(c),
+	})
+}
+
+// updateAccess approves or denies pending requests and adds or removes
+// allow and deny rules.
+func updateAccess(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		message string
+		err     error
+	)
+
+	session := c.Env["session"].(*sessions.Session)
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			session.AddFlash(translateError(getLanguage(c), err), "warning")
+		} else {
+			session.AddFlash(message, "success")
+		}
+		session.Save(req, w)
+		http.Redirect(w, req, "/dashboard/access", http.StatusFound)
+	}()
+
+	lang := getLanguage(c)
+	rule := strings.ToLower(strings.TrimSpace(req.FormValue("rule")))
+	list := req.FormValue("list")
+	if list != "allow" && list != "deny" {
+		list = "allow"
+	}
+
+	if rule == "" {
+		err = errorf("Enter an email, domain or pattern")
+		return
+	}
+	if strings.Contains(rule, ",") {
+		err = errorf("Rules can't contain commas")
+		return
+	}
+	if _, err = path.Match(rule, ""); err != nil {
+		err = errorf("%s isn't a valid pattern", rule)
+		return
+	}
+
+	defer func() {
+		if err == nil {
+			audit(rc, c, req, "access."+req.FormValue("action"), rule, list)
+		}
+	}()
+
+	switch req.FormValue("action") {
+	case "approve":
+		rc.Send("MULTI")
+		rc.Send("ZREM", key("access", "pending"), rule)
+		rc.Send("SADD", key("access", "allow"), rule)
+		_, err = rc.Do("EXEC")
+		message = translate(lang, "%s can log in now", rule)
+	case "deny":
+		rc.Send("MULTI")
+		rc.Send("ZREM", key("access", "pending"), rule)
+		rc.Send("SADD", key("access", "deny"), rule)
+		_, err = rc.Do("EXEC")
+		message = translate(lang, "%s has been denied", rule)
+	case "add":
+		_, err = rc.Do("SADD", key("access", list), rule)
+		message = translate(lang, "Rule added")
+	case "remove":
+		_, err = rc.Do("SREM", key("access", list), rule)
+		message = translate(lang, "Rule removed")
+	default:
+		err = errorf("Unknown action")
+	}
+}
+
+// Teams
+
+// Team is a workspace whose forms are shared by all of its members.
+type Team struct {
+	ID      string
+	Name    string
+	Created int64
+	Role    string `redis:"-"`
+}
+
+type byName []Team
+
+func (t byName) Len() int      { return len(t) }
+func (t byName) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byName) Less(i, j int) bool {
+	return strings.ToLower(t[i].Name) < strings.ToLower(t[j].Name)
+}
+
+// Member is someone in a team. Owners can invite and remove members.
+type Member struct {
+	UID   string
+	Email string
+	Name  string
+	Role  string
+}
+
+type byEmail []Member
+
+func (m byEmail) Len() int      { return len(m) }
+func (m byEmail) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byEmail) Less(i, j int) bool {
+	return strings.ToLower(m[i].Email) < strings.ToLower(m[j].Email)
+}
+
+// hashPairs returns the fields and values of the hash k in a map.
+func hashPairs(rc redis.Conn, k string) (map[string]string, error) {
+	pairs, err := redis.Strings(rc.Do("HGETALL", k))
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for i := 0; i < len(pairs); i += 2 {
+		m[pairs[i]] = pairs[i+1]
+	}
+	return m, nil
+}
+
+// formOwner is the prefix of the keys for the forms of team, or of the
+// ones uid created outside of any team.
+func formOwner(uid string, team string) string {
+	if team != "" {
+		return "team:" + team
+	}
+	return uid
+}
+
+// teamRole returns "owner" or "member", or "" if uid isn't in the team.
+func teamRole(rc redis.Conn, tid string, uid string) (string, error) {
+	role, err := redis.String(rc.Do("HGET", key("team", tid, "members"), uid))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return role, err
+}
+
+// getTeams returns the teams uid is in, sorted by name.
+func getTeams(rc redis.Conn, uid string) ([]Team, error) {
+	var teams []Team
+
+	tids, err := redis.Strings(rc.Do("SMEMBERS", key(uid, "teams")))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tid := range tids {
+		var team Team
+		v, err := redis.Values(rc.Do("HGETALL", key("team", tid)))
+		if err != nil {
+			return nil, err
+		}
+		if err = redis.ScanStruct(v, &team); err != nil {
+			return nil, err
+		}
+		if team.ID == "" {
+			continue
+		}
+		team.Role, err = teamRole(rc, tid, uid)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, team)
+	}
+	sort.Sort(byName(teams))
+	return teams, nil
+}
+
+func getMembers(rc redis.Conn, tid string) ([]Member, error) {
+	var members []Member
+
+	roles, err := hashPairs(rc, key("team", tid, "members"))
+	if err != nil {
+		return nil, err
+	}
+
+	for uid, role := range roles {
+		member := Member{UID: uid, Role: role}
+		v, err := redis.Values(rc.Do("HGETALL", key(uid, "profile")))
+		if err != nil {
+			return nil, err
+		}
+		if err = redis.ScanStruct(v, &member); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	sort.Sort(byEmail(members))
+	return members, nil
+}
+
+// Invites are looked up by a hash of their token in case the database leaks
+func inviteKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return key("invite", hex.EncodeToString(sum[:]))
+}
+
+func createTeam(c web.C, w http.ResponseWriter, req *http.Request) {
+	var err error
+
+	session := c.Env["session"].(*sessions.Session)
+	uid := c.Env["uid"].(string)
+	rc := rp.Get()
+	defer rc.Close()
+
+	name := strings.TrimSpace(req.FormValue("teamName"))
+	if name == "" {
+		session.AddFlash(translate(getLanguage(c), "Workspace name can't be empty"), "warning")
+		session.Save(req, w)
+		http.Redirect(w, req, "/dashboard/", http.StatusFound)
+		return
+	}
+
+	tid := genID()
+	rc.Send("MULTI")
+	rc.Send("HMSET", key("team", tid),
+		"ID", tid,
+		"Name", name,
+		"Created", time.Now().UTC().Unix(),
+	)
+	rc.Send("HSET", key("team", tid, "members"), uid, "owner")
+	rc.Send("SADD", key(uid, "teams"), tid)
+	_, err = rc.Do("EXEC")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	audit(rc, c, req, "team.create", tid, name)
+
+	session.AddFlash(translate(getLanguage(c), "Workspace created"), "success")
+	session.Save(req, w)
+	http.Redirect(w, req, "/dashboard/teams/"+tid, http.StatusFound)
+}
+
+func showTeam(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		team Team
+		err  error
+	)
+
+	uid := c.Env["uid"].(string)
+	tid := c.URLParams["tid"]
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}()
+
+	team.Role, err = teamRole(rc, tid, uid)
+	if err != nil {
+		return
+	}
+	if team.Role == "" {
+		http.Error(w, translate(getLanguage(c), "You're not in that workspace"), http.StatusForbidden)
+		return
+	}
+
+	v, err := redis.Values(rc.Do("HGETALL", key("team", tid)))
+	if err != nil {
+		return
+	}
+	if err = redis.ScanStruct(v, &team); err != nil {
+		return
+	}
+
+	members, err := getMembers(rc, tid)
+	if err != nil {
+		return
+	}
+
+	// Forget invites whose links have expired
+	invites, err := hashPairs(rc, key("team", tid, "invites"))
+	if err != nil {
+		return
+	}
+	var emails []string
+	for email, k := range invites {
+		var exists bool
+		exists, err = redis.Bool(rc.Do("EXISTS", k))
+		if err != nil {
+			return
+		}
+		if !exists {
+			rc.Do("HDEL", key("team", tid, "invites"), email)
+			continue
+		}
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	forms, err := getFormsIn(rc, key("team", tid, "forms"))
+	if err != nil {
+		return
+	}
+
+	r.HTML(w, http.StatusOK, "team", map[string]interface{}{
+		"Team":     team,
+		"UID":      uid,
+		"Members":  members,
+		"Invites":  emails,
+		"Forms":    forms,
+		"Messages": getMessages(c, w, req),
+		"Lang":     getLanguage(c),
+	})
+}
+
+// updateTeam invites, removes and promotes members, cancels invites and
+// lets people leave.
+func updateTeam(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		team    Team
+		message string
+		err     error
+	)
+
+	session := c.Env["session"].(*sessions.Session)
+	uid := c.Env["uid"].(string)
+	tid := c.URLParams["tid"]
+	lang := getLanguage(c)
+	back := "/dashboard/teams/" + tid
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer func() {
+		if err != nil {
+			session.AddFlash(translateError(lang, err), "warning")
+		} else {
+			session.AddFlash(message, "success")
+		}
+		session.Save(req, w)
+		http.Redirect(w, req, back, http.StatusFound)
+	}()
+
+	role, err := teamRole(rc, tid, uid)
+	if err != nil {
+		return
+	}
+	if role == "" {
+		err = errorf("You're not in that workspace")
+		back = "/dashboard/"
+		return
+	}
+
+	v, err := redis.Values(rc.Do("HGETALL", key("team", tid)))
+	if err != nil {
+		return
+	}
+	if err = redis.ScanStruct(v, &team); err != nil {
+		return
+	}
+
+	action := req.FormValue("action")
+	if action != "leave" && role != "owner" {
+		err = errorf("Only workspace owners can do that")
+		return
+	}
+
+	defer func() {
+		if err == nil {
+			audit(rc, c, req, "team."+action, tid, req.FormValue("email")+req.FormValue("uid"))
+		}
+	}()
+
+	switch action {
+	case "invite":
+		email := strings.TrimSpace(req.FormValue("email"))
+		if !strings.Contains(email, "@") {
+			err = errorf("Enter a valid email address")
+			return
+		}
+		email = strings.ToLower(email)
+		// Links in emails only ever start with base-url, which Formic can
+		// run without if it doesn't send any other email
+		if *baseURL == "" {
+			err = errorf("Invites can't be emailed until base-url is set")
+			return
+		}
+
+		token := genToken()
+		k := inviteKey(token)
+		rc.Send("MULTI")
+		rc.Send("HMSET", k,
+			"Team", tid,
+			"Email", email,
+			"InvitedBy", uid,
+		)
+		rc.Send("EXPIRE", k, int64(inviteTTL/time.Second))
+		rc.Send("HSET", key("team", tid, "invites"), email, k)
+		if _, err = rc.Do("EXEC"); err != nil {
+			return
+		}
+
+		inviter := userEmail(rc, uid)
+		err = sendMail(email,
+			translate(lang, "Join %s on Formic", team.Name),
+			translate(lang, "%s invited you to the %s workspace on Formic. Log in and open this link within a week to join:\n\n%s", inviter, team.Name, emailURL("/dashboard/invites/"+token)),
+		)
+		if err != nil {
 			return
 		}
-	}()
+		message = translate(lang, "Invited %s", email)
+	case "cancel":
+		email := req.FormValue("email")
+		k, _ := redis.String(rc.Do("HGET", key("team", tid, "invites"), email))
+		if k != "" {
+			rc.Do("DEL", k)
+		}
+		_, err = rc.Do("HDEL", key("team", tid, "invites"), email)
+		message = translate(lang, "Invite cancelled")
+	case "promote":
+		member := req.FormValue("uid")
+		var memberRole string
+		memberRole, err = teamRole(rc, tid, member)
+		if err != nil {
+			return
+		}
+		if memberRole == "" {
+			err = errorf("They're not in this workspace")
+			return
+		}
+		_, err = rc.Do("HSET", key("team", tid, "members"), member, "owner")
+		message = translate(lang, "Made %s an owner", userEmail(rc, member))
+	case "remove", "leave":
+		member := req.FormValue("uid")
+		if action == "leave" {
+			member = uid
+		}
+		err = removeMember(rc, tid, member)
+		if err != nil {
+			return
+		}
+		if member == uid {
+			back = "/dashboard/"
+			message = translate(lang, "You left %s", team.Name)
+		} else {
+			message = translate(lang, "Removed %s", userEmail(rc, member))
+		}
+	default:
+		err = errorf("Unknown action")
+	}
+}
 
-	session, err := rs.Get(req, "session")
+// removeMember takes someone out of a team as long as someone else is left
+// to own it.
+func removeMember(rc redis.Conn, tid string, uid string) error {
+	members, err := hashPairs(rc, key("team", tid, "members"))
+	if err != nil {
+		return err
+	}
+	if members[uid] == "" {
+		return errorf("They're not in this workspace")
+	}
+	if members[uid] == "owner" {
+		owners := 0
+		for _, role := range members {
+			if role == "owner" {
+				owners++
+			}
+		}
+		if owners == 1 {
+			return errorf("Workspaces need an owner. Make someone else an owner first.")
+		}
+	}
+
+	rc.Send("MULTI")
+	rc.Send("HDEL", key("team", tid, "members"), uid)
+	rc.Send("SREM", key(uid, "teams"), tid)
+	_, err = rc.Do("EXEC")
+	return err
+}
+
+// Invite is an emailed link to join a team.
+type Invite struct {
+	Team      string
+	Email     string
+	InvitedBy string
+}
+
+func getInvite(rc redis.Conn, token string) (Invite, Team, error) {
+	var (
+		invite Invite
+		team   Team
+	)
+
+	v, err := redis.Values(rc.Do("HGETALL", inviteKey(token)))
+	if err != nil {
+		return invite, team, err
+	}
+	if err = redis.ScanStruct(v, &invite); err != nil || invite.Team == "" {
+		return invite, team, err
+	}
+
+	v, err = redis.Values(rc.Do("HGETALL", key("team", invite.Team)))
+	if err != nil {
+		return invite, team, err
+	}
+	err = redis.ScanStruct(v, &team)
+	return invite, team, err
+}
+
+func showInvite(c web.C, w http.ResponseWriter, req *http.Request) {
+	uid := c.Env["uid"].(string)
+	rc := rp.Get()
+	defer rc.Close()
+
+	invite, team, err := getInvite(rc, c.URLParams["token"])
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	session.Options.MaxAge = -1
-	err = session.Save(req, w)
+	status := http.StatusOK
+	if team.ID == "" {
+		status = http.StatusNotFound
+	}
+	email := userEmail(rc, uid)
+	r.HTML(w, status, "invite", map[string]interface{}{
+		"Invite":    invite,
+		"Team":      team,
+		"InvitedBy": userEmail(rc, invite.InvitedBy),
+		"Email":     email,
+		"Match":     strings.EqualFold(email, invite.Email),
+		"Messages":  getMessages(c, w, req),
+		"Lang":      getLanguage(c),
+	})
+}
+
+// acceptInvite adds whoever's logged in to the invite's team as long as they
+// logged in with the email it was sent to.
+func acceptInvite(c web.C, w http.ResponseWriter, req *http.Request) {
+	session := c.Env["session"].(*sessions.Session)
+	uid := c.Env["uid"].(string)
+	token := c.URLParams["token"]
+	lang := getLanguage(c)
+	rc := rp.Get()
+	defer rc.Close()
+
+	invite, team, err := getInvite(rc, token)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if team.ID == "" {
+		http.Error(w, translate(lang, "This invite has expired"), http.StatusNotFound)
+		return
+	}
+	if !strings.EqualFold(userEmail(rc, uid), invite.Email) {
+		http.Error(w, translate(lang, "This invite is for %s", invite.Email), http.StatusForbidden)
 		return
 	}
 
-	http.Redirect(w, req, "/", http.StatusFound)
+	rc.Send("MULTI")
+	rc.Send("HSETNX", key("team", team.ID, "members"), uid, "member")
+	rc.Send("SADD", key(uid, "teams"), team.ID)
+	rc.Send("DEL", inviteKey(token))
+	rc.Send("HDEL", key("team", team.ID, "invites"), invite.Email)
+	if _, err = rc.Do("EXEC"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	audit(rc, c, req, "team.join", team.ID, invite.Email)
+
+	session.AddFlash(translate(lang, "You joined %s", team.Name), "success")
+	session.Save(req, w)
+	http.Redirect(w, req, "/dashboard/teams/"+team.ID, http.StatusFound)
 }
 
-// Dashboard
+// Roles
 
-func showForms(c web.C, w http.ResponseWriter, req *http.Request) {
+// Roles people can have on a form, from least to most access. Viewers can
+// see entries, editors can also change the form and owners can also delete
+// it and share it.
+var formRoles = []string{"viewer", "editor", "owner"}
+
+func roleRank(role string) int {
+	for i, r := range formRoles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// can reports whether someone with role has at least the access of min.
+func can(role string, min string) bool {
+	return role != "" && roleRank(role) >= roleRank(min)
+}
+
+// Grant is a role on a form given to someone by email.
+type Grant struct {
+	Email string
+	Role  string
+}
+
+// formRole returns the role uid has on form, or "" if they have none.
+// Whoever created a form owns it for as long as they're in its workspace,
+// as do the workspace's owners. Other workspace members can edit it and
+// anyone else has whatever role it was shared with them with.
+func formRole(rc redis.Conn, form Form, uid string) (string, error) {
+	var member string
+	if form.Team != "" {
+		var err error
+		member, err = teamRole(rc, form.Team, uid)
+		if err != nil {
+			return "", err
+		}
+	}
+	if form.Owner != "" && form.Owner == uid && (form.Team == "" || member != "") {
+		return "owner", nil
+	}
+
+	// Forms created before they had owners are only in their creator's
+	// forms
+	owned, err := redis.Bool(rc.Do("SISMEMBER", key(uid, "forms"), form.ID))
+	if err != nil {
+		return "", err
+	}
+	if owned {
+		return "owner", nil
+	}
+
+	role := memberRole(member)
+
+	email := strings.ToLower(userEmail(rc, uid))
+	if email == "" {
+		return role, nil
+	}
+	granted, err := redis.String(rc.Do("HGET", key("form", form.ID, "roles"), email))
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+	if roleRank(granted) > roleRank(role) {
+		role = granted
+	}
+	return role, nil
+}
+
+// memberRole is the role someone with teamRole in a workspace has on its
+// forms.
+func memberRole(teamRole string) string {
+	switch teamRole {
+	case "owner":
+		return "owner"
+	case "member":
+		return "editor"
+	}
+	return ""
+}
+
+// setRole sets the role someone has on each of forms.
+func setRole(forms []Form, role string) {
+	for i := range forms {
+		forms[i].Role = role
+	}
+}
+
+func getGrants(rc redis.Conn, fid string) ([]Grant, error) {
+	roles, err := hashPairs(rc, key("form", fid, "roles"))
+	if err != nil {
+		return nil, err
+	}
+	emails := make([]string, 0, len(roles))
+	for email := range roles {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	grants := make([]Grant, len(emails))
+	for i, email := range emails {
+		grants[i] = Grant{Email: email, Role: roles[email]}
+	}
+	return grants, nil
+}
+
+// getSharedForms returns the forms shared with uid's email and their role
+// on each.
+func getSharedForms(rc redis.Conn, uid string) ([]Form, error) {
+	email := strings.ToLower(userEmail(rc, uid))
+	if email == "" {
+		return nil, nil
+	}
+	forms, err := getFormsIn(rc, key("shared", email))
+	if err != nil {
+		return nil, err
+	}
+	for i := range forms {
+		forms[i].Role, err = redis.String(rc.Do(
+			"HGET", key("form", forms[i].ID, "roles"), email,
+		))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+	}
+	return forms, nil
+}
+
+// unlisted returns the shared forms that aren't in listed, so forms shared
+// with someone that are also in one of their workspaces are only listed
+// once. Deleted forms are left out too.
+func unlisted(shared []Form, listed []Form) []Form {
+	seen := make(map[string]bool)
+	for _, form := range listed {
+		seen[form.ID] = true
+	}
+	var forms []Form
+	for _, form := range shared {
+		if form.ID != "" && !seen[form.ID] {
+			forms = append(forms, form)
+		}
+	}
+	return forms
+}
+
+// updateRoles shares a form with someone by email or stops sharing it.
+func updateRoles(c web.C, w http.ResponseWriter, req *http.Request) {
 	var (
-		forms []Form
-		err   error
+		message string
+		err     error
 	)
 
-	uid := c.Env["uid"].(string)
+	session := c.Env["session"].(*sessions.Session)
+	fid := c.URLParams["id"]
+	lang := getLanguage(c)
 	rc := rp.Get()
+	defer rc.Close()
 
 	defer func() {
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			session.AddFlash(translateError(lang, err), "warning")
+		} else {
+			session.AddFlash(message, "success")
 		}
+		session.Save(req, w)
+		http.Redirect(w, req, "/dashboard/"+fid, http.StatusFound)
 	}()
 
-	fids, err := redis.Strings(rc.Do(
-		"SMEMBERS",
-		key(uid, "forms"),
-	))
-	if err != nil {
+	email := strings.ToLower(strings.TrimSpace(req.FormValue("email")))
+	if !strings.Contains(email, "@") {
+		err = errorf("Enter a valid email address")
 		return
 	}
 
-	for _, fid := range fids {
-		var form Form
-		err = getForm(rc, key("form", fid), &form)
-		if err != nil {
+	defer func() {
+		if err == nil {
+			audit(rc, c, req, "form."+req.FormValue("action"), fid,
+				strings.TrimSpace(email+" "+req.FormValue("role")))
+		}
+	}()
+
+	switch req.FormValue("action") {
+	case "share":
+		role := req.FormValue("role")
+		if roleRank(role) == 0 {
+			err = errorf("Unknown role")
 			return
 		}
-		forms = append(forms, form)
+		rc.Send("MULTI")
+		rc.Send("HSET", key("form", fid, "roles"), email, role)
+		rc.Send("SADD", key("shared", email), fid)
+		_, err = rc.Do("EXEC")
+		message = translate(lang, "Shared with %s", email)
+	case "unshare":
+		rc.Send("MULTI")
+		rc.Send("HDEL", key("form", fid, "roles"), email)
+		rc.Send("SREM", key("shared", email), fid)
+		_, err = rc.Do("EXEC")
+		message = translate(lang, "Stopped sharing with %s", email)
+	default:
+		err = errorf("Unknown action")
 	}
+}
 
-	r.HTML(w, http.StatusOK, "forms", map[string]interface{}{
-		"Forms":    forms,
+// Audit
+
+// Event is something someone did on the dashboard or through the API.
+// Actions are named like "form.update" and targets are form IDs, form and
+// entry IDs joined by "/", workspace IDs or access rules.
+type Event struct {
+	Time   int64
+	UID    string
+	Email  string
+	Action string
+	Target string
+	Detail string
+	IP     string
+}
+
+// How many events the audit log page shows at a time. Exports have all of
+// them.
+const auditPageSize = 500
+
+// How many events are read from the audit log at a time
+const auditChunkSize = 1000
+
+// audit appends an event for whoever's logged in to the audit log, which
+// keeps the latest audit-log-size events. Failing to record one doesn't
+// stop the action it records.
+func audit(rc redis.Conn, c web.C, req *http.Request, action string, target string, detail string) {
+	uid, _ := c.Env["uid"].(string)
+	b, err := json.Marshal(Event{
+		Time:   time.Now().UTC().Unix(),
+		UID:    uid,
+		Email:  userEmail(rc, uid),
+		Action: action,
+		Target: target,
+		Detail: detail,
+		IP:     remoteIP(req),
+	})
+	if err == nil {
+		_, err = rc.Do("LPUSH", key("audit"), b)
+	}
+	if err == nil && *auditLogSize > 0 {
+		_, err = rc.Do("LTRIM", key("audit"), 0, *auditLogSize-1)
+	}
+	if err != nil {
+		log.Printf("Couldn't record %s of %s in the audit log: %s", action, target, err)
+	}
+}
+
+// eachEvent calls fn with the audit log's events from index from on, newest
+// first, whose user's email or ID contains user, whose action starts with
+// action and whose target contains target. Empty filters match everything.
+// The log is read a chunk at a time and fn returns false to stop early. It
+// returns the index to carry on from, or 0 if there's nothing left.
+func eachEvent(rc redis.Conn, from int, user string, action string, target string, fn func(Event) bool) (int, error) {
+	user = strings.ToLower(user)
+	for i := from; ; {
+		items, err := redis.Strings(rc.Do("LRANGE", key("audit"), i, i+auditChunkSize-1))
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range items {
+			i++
+			var event Event
+			if err = json.Unmarshal([]byte(item), &event); err != nil {
+				return 0, err
+			}
+			if user != "" &&
+				!strings.Contains(strings.ToLower(event.Email), user) &&
+				!strings.Contains(strings.ToLower(event.UID), user) {
+				continue
+			}
+			if !strings.HasPrefix(event.Action, action) ||
+				!strings.Contains(event.Target, target) {
+				continue
+			}
+			if !fn(event) {
+				n, err := redis.Int(rc.Do("LLEN", key("audit")))
+				if err != nil || i >= n {
+					return 0, err
+				}
+				return i, nil
+			}
+		}
+		if len(items) < auditChunkSize {
+			return 0, nil
+		}
+	}
+}
+
+func showAudit(c web.C, w http.ResponseWriter, req *http.Request) {
+	var events []Event
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	q := req.URL.Query()
+	from, _ := strconv.Atoi(q.Get("from"))
+	if from < 0 {
+		from = 0
+	}
+	next, err := eachEvent(rc, from, q.Get("user"), q.Get("action"), q.Get("target"), func(event Event) bool {
+		events = append(events, event)
+		return len(events) < auditPageSize
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	r.HTML(w, http.StatusOK, "audit", map[string]interface{}{
+		"Events":   events,
+		"Next":     next,
+		"Paged":    from > 0,
+		"User":     q.Get("user"),
+		"Action":   q.Get("action"),
+		"Target":   q.Get("target"),
+		"Query":    req.URL.RawQuery,
 		"Messages": getMessages(c, w, req),
+		"Lang":     getLanguage(c),
 	})
 }
 
-func createForm(c web.C, w http.ResponseWriter, req *http.Request) {
-	var (
-		formName    string
-		redirectURL string
-		err         error
-	)
+// exportAudit downloads the audit log's events matching the same filters
+// as showAudit as CSV. They're written as they're read so the whole log is
+// never held at once.
+func exportAudit(c web.C, w http.ResponseWriter, req *http.Request) {
+	rc := rp.Get()
+	defer rc.Close()
+
+	q := req.URL.Query()
+	audit(rc, c, req, "audit.export", "", req.URL.RawQuery)
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="formic-audit.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Time", "UID", "Email", "Action", "Target", "Detail", "IP"})
+	_, err := eachEvent(rc, 0, q.Get("user"), q.Get("action"), q.Get("target"), func(event Event) bool {
+		cw.Write([]string{
+			time.Unix(event.Time, 0).UTC().Format(time.RFC3339),
+			event.UID,
+			event.Email,
+			event.Action,
+			event.Target,
+			event.Detail,
+			event.IP,
+		})
+		return true
+	})
+	cw.Flush()
+	if err != nil {
+		log.Printf("Couldn't export the audit log: %s", err)
+	}
+}
+
+// Views
+
+// recordView counts a view of form fid by whoever sent req. Visitors are
+// told apart by address and browser so views are only counted once a day
+// without having to set a cookie.
+func recordView(rc redis.Conn, fid string, req *http.Request) error {
+	visitor := fmt.Sprintf("%x", sha1.Sum([]byte(
+		remoteIP(req)+"|"+req.UserAgent(),
+	)))
+	day := key("form", fid, "views", time.Now().UTC().Format("20060102"))
+
+	added, err := redis.Int(rc.Do("SADD", day, visitor))
+	if err != nil {
+		return err
+	}
+	if added > 0 {
+		rc.Do("EXPIRE", day, 48*60*60)
+		rc.Do("INCR", key("form", fid, "views"))
+		rc.Do("SETNX", key("form", fid, "viewsSince"), time.Now().UTC().Unix())
+	}
+	return nil
+}
+
+func trackView(c web.C, w http.ResponseWriter, req *http.Request) {
+	var form Form
 
-	session := c.Env["session"].(*sessions.Session)
-	uid := c.Env["uid"].(string)
 	rc := rp.Get()
+	defer rc.Close()
 
-	defer func() {
+	err := getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if form == (Form{}) {
+		http.Error(w, "Form doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	if err = recordView(rc, form.ID, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if req.Method == "POST" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Write(pixel)
+}
+
+// Hosted
+
+// formClosed returns why a form isn't taking submissions, translated to
+// lang, or an empty string if it is.
+func formClosed(rc redis.Conn, form Form, lang string) (string, error) {
+	now := time.Now().UTC().Unix()
+	when := func(ts int64) string {
+		return time.Unix(ts, 0).UTC().Format("Jan 2, 2006 15:04 MST")
+	}
+
+	switch {
+	case form.Disabled:
+		return translate(lang, "This form isn't accepting responses."), nil
+	case form.OpensAt > 0 && now < form.OpensAt:
+		return translate(lang, "This form opens on %s.", when(form.OpensAt)), nil
+	case form.ClosesAt > 0 && now >= form.ClosesAt:
+		return translate(lang, "This form closed on %s.", when(form.ClosesAt)), nil
+	}
+
+	if form.MaxEntries > 0 {
+		n, err := redis.Int64(rc.Do("ZCARD", key("form", form.ID, "entries")))
 		if err != nil {
-			session.AddFlash(err.Error(), "warning")
-			session.Save(req, w)
-			showForms(c, w, req)
-			return
+			return "", err
 		}
+		if n >= form.MaxEntries {
+			return translate(lang, "This form has reached its limit of responses."), nil
+		}
+	}
+	return "", nil
+}
+
+// renderClosed tells people a form is closed, with its closed message if
+// it has one.
+func renderClosed(w http.ResponseWriter, req *http.Request, form Form, reason string) {
+	if wantsJSON(req) {
+		r.JSON(w, http.StatusForbidden, map[string]interface{}{
+			"Error":  reason,
+			"Closed": true,
+		})
+		return
+	}
+
+	renderPublic(w, req, http.StatusForbidden, "closed", form, map[string]interface{}{
+		"Reason":  reason,
+		"Message": renderMarkdown(form.ClosedMessage),
+	})
+}
+
+// renderHosted shows a page of a hosted form along with whatever's been
+// filled in so far.
+func renderHosted(w http.ResponseWriter, req *http.Request, status int, form Form, def Definition, partial Partial, errs map[string]string, notice string) {
+	pages := splitPages(def)
+	page := partial.Page
+	if page < 0 || page >= len(pages) {
+		page = 0
+	}
+
+	values := partial.Values
+	if values == nil {
+		values = url.Values{}
+	}
+	if errs == nil {
+		errs = make(map[string]string)
+	}
 
-		id := genID()
+	var resumeURL string
+	if partial.Updated > 0 {
+		u := createURL(req)
+		u.Path = fmt.Sprintf("/f/%s", form.ID)
+		u.RawQuery = url.Values{"resume": {partial.Token}}.Encode()
+		resumeURL = u.String()
+	}
 
-		rc.Do("HMSET", key("form", id),
-			"ID", id,
-			"Name", formName,
-			"RedirectURL", redirectURL,
-		)
+	renderPublic(w, req, status, "hosted", form, map[string]interface{}{
+		"Definition":     def,
+		"Page":           pages[page],
+		"PageIndex":      page,
+		"Step":           page + 1,
+		"Steps":          len(pages),
+		"Percent":        (page + 1) * 100 / len(pages),
+		"Token":          partial.Token,
+		"IdempotencyKey": genToken(),
+		"ResumeURL":      resumeURL,
+		"Values":         values,
+		"Errors":         errs,
+		"Notice":         notice,
+	})
+}
 
-		rc.Do("SADD", key(uid, "forms"), id)
+func showHostedForm(c web.C, w http.ResponseWriter, req *http.Request) {
+	var (
+		form    Form
+		partial Partial
+		notice  string
+	)
 
-		session.AddFlash("Form created", "success")
-		session.Save(req, w)
+	rc := rp.Get()
+	defer rc.Close()
 
-		url := fmt.Sprintf("/dashboard/%s", id)
-		http.Redirect(w, req, url, http.StatusFound)
-	}()
+	err := getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	if err = req.ParseForm(); err != nil {
+	if form == (Form{}) {
+		http.Error(w, "Form doesn't exist", http.StatusNotFound)
 		return
 	}
 
-	formName = req.PostForm.Get("formName")
-	if formName == "" {
-		err = errors.New("Form name can't be empty")
+	def, err := parseDefinition(form.Definition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	redirectURL = req.PostForm.Get("redirectURL")
-	if redirectURL == "" {
-		err = errors.New("Redirect URL can't be empty")
+	if len(def.Fields) == 0 {
+		http.Error(w, "Form doesn't have a hosted page", http.StatusNotFound)
+		return
+	}
+
+	reason, err := formClosed(rc, form, negotiateLanguage(req, form.Language))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reason != "" {
+		renderClosed(w, req, form, reason)
 		return
 	}
+
+	if token := req.URL.Query().Get("resume"); token != "" {
+		err = getPartial(rc, form.ID, token, &partial)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if partial.Token == "" {
+			notice = "We couldn't find your saved answers. They may have expired."
+		}
+	}
+
+	// Hosted forms count their own views so they have a conversion rate
+	// without the tracking pixel
+	if err = recordView(rc, form.ID, req); err != nil {
+		log.Printf("Couldn't record a view of %s: %s", form.ID, err)
+	}
+
+	renderHosted(w, req, http.StatusOK, form, def, partial, nil, notice)
 }
 
-func showForm(c web.C, w http.ResponseWriter, req *http.Request) {
+// continueHostedForm takes the answers to a page of a hosted form. They're
+// saved under a resume token until the last page is submitted and they
+// become an entry.
+func continueHostedForm(c web.C, w http.ResponseWriter, req *http.Request) {
 	var (
 		form    Form
-		entries []interface{}
+		partial Partial
 		err     error
 	)
 
 	rc := rp.Get()
+	defer rc.Close()
 
 	defer func() {
 		if err != nil {
@@ -393,135 +5737,311 @@ func showForm(c web.C, w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	formURL := createURL(req)
-	formURL.Path = fmt.Sprintf("/s/%s", form.ID)
-
-	fields, err := redis.Strings(rc.Do(
-		"SMEMBERS",
-		key("form", form.ID, "fields"),
-	))
+	def, err := parseDefinition(form.Definition)
 	if err != nil {
 		return
 	}
 
-	v, err := redis.Values(rc.Do(
-		"ZREVRANGEBYSCORE",
-		key("form", form.ID, "entries"),
-		"+inf", "-inf", "WITHSCORES",
-	))
+	if len(def.Fields) == 0 {
+		http.Error(w, "Form doesn't have a hosted page", http.StatusNotFound)
+		return
+	}
+
+	reason, err := formClosed(rc, form, negotiateLanguage(req, form.Language))
 	if err != nil {
 		return
 	}
-	ems := make([]EntryMeta, len(v)/2)
-	for i := range ems {
-		v, err = redis.Scan(v, &ems[i].ID, &ems[i].Submitted)
+	if reason != "" {
+		renderClosed(w, req, form, reason)
+		return
 	}
 
-	for _, em := range ems {
-		v, err := redis.Strings(
-			rc.Do("HGETALL", key("form", form.ID, "entry", em.ID)),
-		)
+	if status, err := parseSubmission(w, req); err != nil {
+		rejectSubmission(w, req, status, negotiateLanguage(req, form.Language), err)
+		return
+	}
+
+	if token := req.PostForm.Get("_resume"); token != "" {
+		err = getPartial(rc, form.ID, token, &partial)
 		if err != nil {
 			return
 		}
+	}
+	if partial.Token == "" {
+		partial = Partial{
+			Token:  genToken(),
+			Values: url.Values{},
+			Meta:   entryMeta(req, form),
+		}
+	}
+
+	pages := splitPages(def)
+	page, _ := strconv.Atoi(req.PostForm.Get("_page"))
+	if page < 0 || page >= len(pages) {
+		page = 0
+	}
+	partial.Page = page
+
+	// Only this page's answers were posted. Fields left out were either
+	// hidden or cleared so don't hold on to what they were before.
+	onPage := make(map[string]bool)
+	for _, field := range pages[page].Fields {
+		onPage[field.Name] = true
+		partial.Values.Del(field.Name)
+		if v, ok := req.PostForm[field.Name]; ok {
+			partial.Values[field.Name] = v
+		}
+	}
 
-		entry := map[string]interface{}{
-			"Submitted": time.Unix(em.Submitted, 0).UTC().Format(time.Stamp),
+	resumeURL := fmt.Sprintf("/f/%s?resume=%s", form.ID, url.QueryEscape(partial.Token))
+
+	switch req.PostForm.Get("_action") {
+	case "back":
+		if page > 0 {
+			partial.Page = page - 1
+		}
+		if err = savePartial(rc, form.ID, &partial); err != nil {
+			return
 		}
-		for i := 0; i < len(v); i += 2 {
-			entry[v[i]] = v[i+1]
+		http.Redirect(w, req, resumeURL, http.StatusFound)
+		return
+	case "save":
+		if err = savePartial(rc, form.ID, &partial); err != nil {
+			return
 		}
+		u := createURL(req)
+		u.RawQuery = url.Values{"resume": {partial.Token}}.Encode()
+		renderPublic(w, req, http.StatusOK, "saved", form, map[string]interface{}{
+			"ResumeURL": u.String(),
+		})
+		return
+	}
 
-		entries = append(entries, entry)
+	lang := negotiateLanguage(req, form.Language)
+
+	// Submitting the last page twice shouldn't save two entries
+	var eid string
+	idempotencyKey := req.PostForm.Get("_idempotency")
+	if idempotencyKey != "" && page == len(pages)-1 {
+		eid, err = claimIdempotencyKey(rc, form.ID, idempotencyKey)
+		if _, ok := err.(userError); ok {
+			rejectSubmission(w, req, http.StatusConflict, lang, err)
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if eid != "" {
+			redirectSubmitted(w, req, form, eid, partial.Values)
+			return
+		}
+		defer func() {
+			releaseIdempotencyKey(rc, form.ID, idempotencyKey, eid)
+		}()
 	}
 
-	r.HTML(w, http.StatusOK, "form", map[string]interface{}{
-		"Form":     form,
-		"FormURL":  formURL.String(),
-		"Fields":   fields,
-		"Entries":  entries,
-		"Messages": getMessages(c, w, req),
-	})
-}
+	errs := validateEntry(def, partial.Values, lang)
 
-func updateForm(c web.C, w http.ResponseWriter, req *http.Request) {
-	var (
-		formName    string
-		redirectURL string
-		err         error
-	)
+	pageErrs := make(map[string]string)
+	for name, message := range errs {
+		if onPage[name] {
+			pageErrs[name] = message
+		}
+	}
+	if len(pageErrs) > 0 {
+		renderHosted(w, req, http.StatusBadRequest, form, def, partial, pageErrs, "")
+		return
+	}
 
-	session := c.Env["session"].(*sessions.Session)
-	rc := rp.Get()
+	if page < len(pages)-1 {
+		partial.Page = page + 1
+		if err = savePartial(rc, form.ID, &partial); err != nil {
+			return
+		}
+		http.Redirect(w, req, resumeURL, http.StatusFound)
+		return
+	}
 
-	defer func() {
+	if len(errs) == 0 {
+		var existing string
+		existing, err = checkUnique(rc, form, def, partial.Values, errs, lang)
 		if err != nil {
-			session.AddFlash(err.Error(), "warning")
-			session.Save(req, w)
-			showForm(c, w, req)
 			return
 		}
+		if len(errs) == 0 {
+			eid, err = saveEntry(rc, form, def, existing, partial.Values, partial.Meta)
+			if err == errDuplicate {
+				_, err = checkUnique(rc, form, def, partial.Values, errs, lang)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
 
-		rc.Do("HMSET", key("form", c.URLParams["id"]),
-			"Name", formName,
-			"RedirectURL", redirectURL,
-		)
+	// Earlier pages can still be missing answers if their saved ones
+	// expired, so send people back to the first one that needs fixing
+	if len(errs) > 0 {
+	first:
+		for i, p := range pages {
+			for _, field := range p.Fields {
+				if _, ok := errs[field.Name]; ok {
+					partial.Page = i
+					break first
+				}
+			}
+		}
+		renderHosted(w, req, http.StatusBadRequest, form, def, partial, errs, "")
+		return
+	}
 
-		session.AddFlash("Form updated", "info")
-		session.Save(req, w)
-		showForm(c, w, req)
-	}()
+	deletePartial(rc, form.ID, partial.Token)
 
-	if err = req.ParseForm(); err != nil {
+	redirectSubmitted(w, req, form, eid, partial.Values)
+}
+
+func showLogo(c web.C, w http.ResponseWriter, req *http.Request) {
+	rc := rp.Get()
+	defer rc.Close()
+
+	logo, err := redis.Values(rc.Do(
+		"HMGET", key("form", c.URLParams["id"], "logo"),
+		"Type", "Data",
+	))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	formName = req.PostForm.Get("formName")
-	if formName == "" {
-		err = errors.New("Form name can't be empty")
+	contentType, _ := redis.String(logo[0], nil)
+	data, _ := redis.Bytes(logo[1], nil)
+	if !contains(logoTypes, contentType) || len(data) == 0 {
+		http.Error(w, "Form doesn't have a logo", http.StatusNotFound)
 		return
 	}
 
-	redirectURL = req.PostForm.Get("redirectURL")
-	if redirectURL == "" {
-		err = errors.New("Redirect URL can't be empty")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	w.Write(data)
+}
+
+func showThanks(c web.C, w http.ResponseWriter, req *http.Request) {
+	var form Form
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	err := getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if form == (Form{}) {
+		http.Error(w, "Form doesn't exist", http.StatusNotFound)
 		return
 	}
+
+	renderPublic(w, req, http.StatusOK, "thanks", form, map[string]interface{}{
+		"Message": renderMarkdown(form.ThankYou),
+	})
 }
 
-func deleteForm(c web.C, w http.ResponseWriter, req *http.Request) {
-	var (
-		err error
-	)
+// Embed
+
+func embedForm(c web.C, w http.ResponseWriter, req *http.Request) {
+	var form Form
 
-	session := c.Env["session"].(*sessions.Session)
-	uid := c.Env["uid"].(string)
 	rc := rp.Get()
+	defer rc.Close()
 
-	defer func() {
+	err := getForm(rc, key("form", c.URLParams["id"]), &form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if form == (Form{}) {
+		http.Error(w, "Form doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	def, err := parseDefinition(form.Definition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var src []byte
+	for _, name := range []string{"rules.js", "embed.js"} {
+		b, err := ioutil.ReadFile("static/js/" + name)
 		if err != nil {
-			session.AddFlash(err.Error(), "warning")
-			session.Save(req, w)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		session.AddFlash("Form deleted", "success")
-		session.Save(req, w)
-	}()
+		src = append(src, b...)
+	}
+
+	formURL := createURL(req)
+	formURL.Path = fmt.Sprintf("/s/%s", form.ID)
 
-	_, err = rc.Do("SADD", key(uid, "deletedForms"), c.URLParams["id"])
+	lang := negotiateLanguage(req, form.Language)
+	closed, err := formClosed(rc, form, lang)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	_, err = rc.Do("SREM", key(uid, "forms"), c.URLParams["id"])
+	config, err := json.Marshal(map[string]interface{}{
+		"Action": formURL.String(),
+		"Name":   form.Name,
+		"Fields": def.Fields,
+		"Rules":  def.Rules,
+		"Closed": closed,
+		"Messages": map[string]string{
+			"Submit":  translate(lang, "Submit"),
+			"Invalid": translate(lang, "Please fix the errors above and try again."),
+			"Failed":  translate(lang, "Something went wrong. Please try again."),
+		},
+	})
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// The script is loaded by the page the form is embedded in so loading
+	// it is a view, as long as browsers don't cache it
+	if closed == "" {
+		if err = recordView(rc, form.ID, req); err != nil {
+			log.Printf("Couldn't record a view of %s: %s", form.ID, err)
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/javascript; charset=UTF-8")
+	fmt.Fprintf(
+		w,
+		"(function() {\n%s\nformicEmbed(%s, document.currentScript);\n})();\n",
+		src, config,
+	)
 }
 
 // Submit
 
+// respondSubmitted tells whoever submitted entry eid that it was saved.
+func respondSubmitted(w http.ResponseWriter, req *http.Request, form Form, lang string, eid string, values url.Values) {
+	if wantsJSON(req) {
+		r.JSON(w, http.StatusOK, map[string]string{
+			"ID":      eid,
+			"Message": translate(lang, "Thanks! Your response has been recorded."),
+		})
+		return
+	}
+
+	redirectSubmitted(w, req, form, eid, values)
+}
+
 func submitEntry(c web.C, w http.ResponseWriter, req *http.Request) {
 	var (
 		form Form
@@ -529,6 +6049,10 @@ func submitEntry(c web.C, w http.ResponseWriter, req *http.Request) {
 	)
 
 	rc := rp.Get()
+	defer rc.Close()
+
+	// Let embedded forms read the result of their submissions
+	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	defer func() {
 		if err != nil {
@@ -547,23 +6071,100 @@ func submitEntry(c web.C, w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := req.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	def, err := parseDefinition(form.Definition)
+	if err != nil {
 		return
 	}
 
-	eid := genID()
+	lang := negotiateLanguage(req, form.Language)
 
-	entry := []interface{}{key("form", form.ID, "entry", eid)}
-	for field := range req.PostForm {
-		entry = append(entry, field, req.PostForm.Get(field))
-		rc.Do("SADD", key("form", form.ID, "fields"), field)
+	if status, err := parseSubmission(w, req); err != nil {
+		rejectSubmission(w, req, status, lang, err)
+		return
+	}
+
+	// Retried submissions are recognized by their idempotency key, which
+	// forms without JavaScript can send as a hidden field
+	var eid string
+	idempotencyKey := req.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		idempotencyKey = req.PostForm.Get("_idempotency")
+	}
+	req.PostForm.Del("_idempotency")
+	if idempotencyKey != "" {
+		eid, err = claimIdempotencyKey(rc, form.ID, idempotencyKey)
+		if _, ok := err.(userError); ok {
+			rejectSubmission(w, req, http.StatusConflict, lang, err)
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if eid != "" {
+			respondSubmitted(w, req, form, lang, eid, req.PostForm)
+			return
+		}
+		defer func() {
+			releaseIdempotencyKey(rc, form.ID, idempotencyKey, eid)
+		}()
+	}
+
+	reason, err := formClosed(rc, form, lang)
+	if err != nil {
+		return
+	}
+	if reason != "" {
+		renderClosed(w, req, form, reason)
+		return
+	}
+
+	errs := validateEntry(def, req.PostForm, lang)
+	if len(errs) == 0 {
+		var existing string
+		existing, err = checkUnique(rc, form, def, req.PostForm, errs, lang)
+		if err != nil {
+			return
+		}
+		if len(errs) == 0 {
+			eid, err = saveEntry(rc, form, def, existing, req.PostForm, entryMeta(req, form))
+			if err == errDuplicate {
+				_, err = checkUnique(rc, form, def, req.PostForm, errs, lang)
+			}
+			if err != nil {
+				return
+			}
+		}
 	}
-	rc.Do("HMSET", entry...)
 
-	rc.Do("ZADD", key("form", form.ID, "entries"), time.Now().UTC().Unix(), eid)
+	if len(errs) > 0 {
+		if wantsJSON(req) {
+			r.JSON(w, http.StatusBadRequest, map[string]interface{}{
+				"Errors": errs,
+			})
+			return
+		}
+		if form.FailureURL != "" {
+			url, err := expandRedirect(form.FailureURL, form, "", req.PostForm, errs)
+			if err == nil {
+				err = checkRedirect(url)
+			}
+			if err == nil {
+				http.Redirect(w, req, url, http.StatusFound)
+				return
+			}
+			log.Printf("Couldn't redirect to failure URL of form %s: %s", form.ID, err)
+		}
+		var messages []string
+		for _, message := range errs {
+			messages = append(messages, message)
+		}
+		sort.Strings(messages)
+		http.Error(w, strings.Join(messages, "\n"), http.StatusBadRequest)
+		return
+	}
 
-	http.Redirect(w, req, form.RedirectURL, http.StatusFound)
+	respondSubmitted(w, req, form, lang, eid, req.PostForm)
 }
 
 // Init
@@ -573,7 +6174,13 @@ func init() {
 		Layout: "layout",
 		Funcs: []template.FuncMap{
 			template.FuncMap{
-				"Title": strings.Title,
+				"Title":    strings.Title,
+				"Time":     formatTime,
+				"Date":     formatDate,
+				"Schedule": formatSchedule,
+				"Contains": contains,
+				"Can":      can,
+				"T":        translate,
 			},
 		},
 		IsDevelopment: true,
@@ -604,18 +6211,59 @@ func init() {
 func main() {
 	config.SetPrefix("FORMIC_")
 	config.Parse("formic.toml")
+	setConfigRules(*allowedEmails, *googleAllowedEmails, *deniedEmails, *admins)
+
+	// Access rules can change without a restart: edit formic.toml and send
+	// Formic SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfigRules("formic.toml"); err != nil {
+				log.Printf("Couldn't reload access rules: %s", err)
+				continue
+			}
+			log.Print("Reloaded access rules")
+		}
+	}()
+
+	if err := loadCatalogs(); err != nil {
+		fmt.Printf("Couldn't load translations: %s\n", err)
+		os.Exit(1)
+	}
+
+	// The OpenID provider's name is only known once it's configured
+	for _, p := range providers {
+		if p.Name == "oidc" {
+			p.Label = *oidcName
+		}
+	}
 
 	missingConfig := make([]string, 0)
 	for n, v := range map[string]string{
-		"Session Secret":        *sessionSecret,
-		"Google Client ID":      *googleClientID,
-		"Google Client Secret":  *googleClientSecret,
-		"Google ALlowed Emails": *googleAllowedEmails,
+		"Session Secret":           *sessionSecret,
+		"Allowed Emails or Admins": *allowedEmails + *googleAllowedEmails + *admins,
 	} {
 		if v == "" {
 			missingConfig = append(missingConfig, n)
 		}
 	}
+	// Emailed links need base-url. Without SMTP or local accounts the only
+	// emails are workspace invites, which are refused until it's set.
+	if *baseURL == "" && (*smtpHost != "" || *localAccounts) {
+		missingConfig = append(missingConfig, "Base URL")
+	}
+	if len(enabledProviders()) == 0 && !*localAccounts {
+		missingConfig = append(missingConfig, "Login Provider Client ID or Local Accounts")
+	}
+	for _, p := range enabledProviders() {
+		if *p.ClientSecret == "" {
+			missingConfig = append(missingConfig, p.Label+" Client Secret")
+		}
+	}
+	if *oidcClientID != "" && *oidcIssuer == "" {
+		missingConfig = append(missingConfig, "OpenID Connect Issuer")
+	}
 	if len(missingConfig) > 0 {
 		fmt.Printf(
 			"Missing config: %s\n",
@@ -624,6 +6272,16 @@ func main() {
 		os.Exit(1)
 	}
 	goji.Get("/", index)
+	goji.Get("/login", requireLocalAccounts(showLogin))
+	goji.Post("/login", requireLocalAccounts(localLogin))
+	goji.Get("/signup", requireLocalAccounts(showSignup))
+	goji.Post("/signup", requireLocalAccounts(signup))
+	goji.Get("/reset", requireLocalAccounts(showForgot))
+	goji.Post("/reset", requireLocalAccounts(forgotPassword))
+	goji.Get("/confirm/:token", requireLocalAccounts(confirmEmail))
+	goji.Get("/reset/:token", requireLocalAccounts(showReset))
+	goji.Post("/reset/:token", requireLocalAccounts(resetPassword))
+	goji.Get("/login/:provider", startLogin)
 	goji.Get("/oauth2callback", login)
 	goji.Get("/logout", logout)
 
@@ -633,13 +6291,55 @@ func main() {
 	dashboard.Use(requireLogin)
 	dashboard.Get("/", showForms)
 	dashboard.Post("/", createForm)
-	dashboard.Get("/:id", showForm)
-	dashboard.Post("/:id", updateForm)
-	dashboard.Delete("/:id", deleteForm)
+	dashboard.Post("/language", updateLanguage)
+	dashboard.Get("/access", requireAdmin(showAccess))
+	dashboard.Post("/access", requireAdmin(updateAccess))
+	dashboard.Get("/audit", requireAdmin(showAudit))
+	dashboard.Get("/audit.csv", requireAdmin(exportAudit))
+	dashboard.Post("/teams", createTeam)
+	dashboard.Get("/teams/:tid", showTeam)
+	dashboard.Post("/teams/:tid", updateTeam)
+	dashboard.Get("/invites/:token", showInvite)
+	dashboard.Post("/invites/:token", acceptInvite)
+	dashboard.Get("/:id", requireRole("viewer", showForm))
+	dashboard.Post("/:id", requireRole("editor", updateForm))
+	dashboard.Delete("/:id", requireRole("owner", deleteForm))
+	dashboard.Post("/:id/team", requireRole("owner", moveForm))
+	dashboard.Post("/:id/roles", requireRole("owner", updateRoles))
+	dashboard.Get("/:id/stats", requireRole("viewer", showStats))
+	dashboard.Get("/:id/builder", requireRole("editor", showBuilder))
+	dashboard.Post("/:id/builder", requireRole("editor", updateDefinition))
+	dashboard.Get("/:id/theme", requireRole("editor", showTheme))
+	dashboard.Post("/:id/theme", requireRole("editor", updateTheme))
+	dashboard.Get("/:id/entries/:eid.json", requireRole("viewer", showEntryJSON))
+	dashboard.Get("/:id/entries/:eid", requireRole("viewer", showEntry))
+	dashboard.Post("/:id/entries/:eid", requireRole("editor", updateEntry))
+	dashboard.Post("/:id/entries/:eid/comments", requireRole("editor", createComment))
 	goji.Handle("/dashboard/*", dashboard)
 
+	api := web.New()
+	api.Use(middleware.SubRouter)
+	api.Use(sessionEnv)
+	api.Use(requireAPILogin)
+	api.Get("/forms", apiForms)
+	api.Get("/forms/:id/stats", requireAPIRole("viewer", apiStats))
+	api.Get("/forms/:id/entries", requireAPIRole("viewer", apiEntries))
+	api.Get("/forms/:id/entries/:eid", requireAPIRole("viewer", apiEntry))
+	api.Patch("/forms/:id/entries/:eid", requireAPIRole("editor", apiUpdateEntry))
+	goji.Handle("/api/*", api)
+
+	goji.Get("/v/:id", trackView)
+	goji.Post("/v/:id", trackView)
+
 	goji.Post("/s/:id", submitEntry)
 
+	goji.Get("/embed/:id.js", embedForm)
+
+	goji.Get("/f/:id", showHostedForm)
+	goji.Post("/f/:id", continueHostedForm)
+	goji.Get("/f/:id/thanks", showThanks)
+	goji.Get("/f/:id/logo", showLogo)
+
 	goji.Get("/static/lib/*", http.StripPrefix(
 		"/static/lib/",
 		http.FileServer(
@@ -0,0 +1,223 @@
+// Formic embeddable form. Served by /embed/<id>.js along with rules.js,
+// which calls formicEmbed with the form's definition right after this file.
+// Pages of multi-step forms are shown one after the other, under their
+// titles.
+//
+// Style it by setting any of these CSS variables on the page:
+//
+//   --formic-font, --formic-color, --formic-background, --formic-border,
+//   --formic-radius, --formic-accent, --formic-accent-color,
+//   --formic-error, --formic-success
+
+var formicStyle = [
+  '.formic-form { font-family: var(--formic-font, inherit); color: var(--formic-color, inherit); }',
+  '.formic-form .formic-field { margin-bottom: 1em; }',
+  '.formic-form .formic-page { margin: 1.5em 0 1em 0; }',
+  '.formic-form label { display: block; margin-bottom: 0.25em; }',
+  '.formic-form .formic-choice { font-weight: normal; }',
+  '.formic-form input[type=text], .formic-form input[type=email], .formic-form input[type=number],',
+  '.formic-form input[type=tel], .formic-form input[type=url], .formic-form input[type=date],',
+  '.formic-form textarea, .formic-form select {',
+  '  box-sizing: border-box; width: 100%; padding: 0.5em; font: inherit;',
+  '  color: var(--formic-color, inherit); background: var(--formic-background, transparent);',
+  '  border: 1px solid var(--formic-border, silver); border-radius: var(--formic-radius, 4px);',
+  '}',
+  '.formic-form .formic-invalid input, .formic-form .formic-invalid textarea,',
+  '.formic-form .formic-invalid select { border-color: var(--formic-error, crimson); }',
+  '.formic-form .formic-help { opacity: 0.7; font-size: 0.9em; margin: 0.25em 0 0 0; }',
+  '.formic-form .formic-error { color: var(--formic-error, crimson); font-size: 0.9em; margin: 0.25em 0 0 0; }',
+  '.formic-form button {',
+  '  padding: 0.5em 1.5em; font: inherit; cursor: pointer; border: 0;',
+  '  border-radius: var(--formic-radius, 4px);',
+  '  background: var(--formic-accent, #333); color: var(--formic-accent-color, white);',
+  '}',
+  '.formic-form button[disabled] { opacity: 0.5; }',
+  '.formic-form .formic-status.formic-success { color: var(--formic-success, yellowgreen); }',
+  '.formic-form .formic-status.formic-failure { color: var(--formic-error, crimson); }'
+].join('\n');
+
+function formicEl(tag, props, children) {
+  var node = document.createElement(tag);
+  for (var prop in props) {
+    node[prop] = props[prop];
+  }
+  (children || []).forEach(function(child) {
+    node.appendChild(child);
+  });
+  return node;
+}
+
+function formicField(field) {
+  var id = 'formic-' + field.Name + '-' + Math.random().toString(36).slice(2);
+  var label = field.Label + (field.Required ? ' *' : '');
+  var node = formicEl('div', {className: 'formic-field'});
+  var options = field.Options || [];
+  node.setAttribute('data-field', field.Name);
+  node.setAttribute('data-required', !!field.Required);
+
+  if (field.Type === 'checkbox' && !options.length) {
+    node.appendChild(formicEl('label', {className: 'formic-choice'}, [
+      formicEl('input', {type: 'checkbox', name: field.Name, value: 'yes'}),
+      document.createTextNode(' ' + label)
+    ]));
+  } else if (field.Type === 'checkbox' || field.Type === 'radio') {
+    node.appendChild(formicEl('label', {textContent: label}));
+    options.forEach(function(option) {
+      node.appendChild(formicEl('label', {className: 'formic-choice'}, [
+        formicEl('input', {type: field.Type, name: field.Name, value: option}),
+        document.createTextNode(' ' + option)
+      ]));
+    });
+  } else {
+    node.appendChild(formicEl('label', {htmlFor: id, textContent: label}));
+    if (field.Type === 'textarea') {
+      node.appendChild(formicEl('textarea', {
+        id: id,
+        name: field.Name,
+        placeholder: field.Placeholder || ''
+      }));
+    } else if (field.Type === 'select') {
+      var select = formicEl('select', {id: id, name: field.Name}, [
+        formicEl('option', {value: '', textContent: field.Placeholder || ''})
+      ]);
+      options.forEach(function(option) {
+        select.appendChild(formicEl('option', {value: option, textContent: option}));
+      });
+      node.appendChild(select);
+    } else {
+      node.appendChild(formicEl('input', {
+        id: id,
+        type: field.Type,
+        name: field.Name,
+        placeholder: field.Placeholder || ''
+      }));
+    }
+  }
+
+  if (field.Help) {
+    node.appendChild(formicEl('p', {className: 'formic-help', textContent: field.Help}));
+  }
+  return node;
+}
+
+// formicKey makes the idempotency key that keeps retried submissions from
+// being saved twice. It's sent as a field since a header would need a CORS
+// preflight.
+function formicKey() {
+  var bytes = new Uint8Array(16);
+  (window.crypto || window.msCrypto).getRandomValues(bytes);
+  return Array.prototype.map.call(bytes, function(b) {
+    return ('0' + b.toString(16)).slice(-2);
+  }).join('');
+}
+
+function formicEmbed(config, script) {
+  if (!document.getElementById('formic-style')) {
+    document.head.appendChild(formicEl('style', {
+      id: 'formic-style',
+      textContent: formicStyle
+    }));
+  }
+
+  if (config.Closed) {
+    script.parentNode.insertBefore(formicEl('p', {
+      className: 'formic-status formic-closed',
+      textContent: config.Closed
+    }), script.nextSibling);
+    return;
+  }
+
+  var form = formicEl('form', {
+    className: 'formic-form',
+    action: config.Action,
+    method: 'post',
+    noValidate: true
+  });
+  var fields = {};
+  (config.Fields || []).forEach(function(field) {
+    if (field.Type === 'page') {
+      if (field.Label) {
+        form.appendChild(formicEl('h3', {
+          className: 'formic-page',
+          textContent: field.Label
+        }));
+      }
+      return;
+    }
+    fields[field.Name] = formicField(field);
+    form.appendChild(fields[field.Name]);
+  });
+  var messages = config.Messages || {};
+  var button = formicEl('button', {
+    type: 'submit',
+    textContent: messages.Submit || 'Submit'
+  });
+  var status = formicEl('p', {className: 'formic-status'});
+  var idempotencyKey = formicKey();
+  form.appendChild(formicEl('div', {className: 'formic-field'}, [button]));
+  form.appendChild(status);
+
+  function reset() {
+    status.textContent = '';
+    status.className = 'formic-status';
+    Array.prototype.forEach.call(
+      form.querySelectorAll('.formic-error'),
+      function(el) {
+        el.parentNode.classList.remove('formic-invalid');
+        el.remove();
+      }
+    );
+  }
+
+  function fail(message) {
+    status.textContent = message;
+    status.className = 'formic-status formic-failure';
+  }
+
+  form.addEventListener('submit', function(e) {
+    e.preventDefault();
+    reset();
+    button.disabled = true;
+    var body = new URLSearchParams(new FormData(form));
+    body.append('_idempotency', idempotencyKey);
+    fetch(config.Action, {
+      method: 'POST',
+      headers: {'Accept': 'application/json'},
+      body: body
+    }).then(function(res) {
+      return res.json().then(function(data) {
+        return {ok: res.ok, data: data};
+      });
+    }).then(function(result) {
+      button.disabled = false;
+      if (result.ok) {
+        form.reset();
+        idempotencyKey = formicKey();
+        status.textContent = result.data.Message;
+        status.className = 'formic-status formic-success';
+        return;
+      }
+      if (result.data.Error) {
+        fail(result.data.Error);
+        return;
+      }
+      var errors = result.data.Errors || {};
+      for (var name in errors) {
+        if (fields[name]) {
+          fields[name].classList.add('formic-invalid');
+          fields[name].appendChild(formicEl('p', {
+            className: 'formic-error',
+            textContent: errors[name]
+          }));
+        }
+      }
+      fail(messages.Invalid || 'Please fix the errors above and try again.');
+    }).catch(function() {
+      button.disabled = false;
+      fail(messages.Failed || 'Something went wrong. Please try again.');
+    });
+  });
+
+  formicRules(form, config.Rules);
+  script.parentNode.insertBefore(form, script.nextSibling);
+}
@@ -0,0 +1,100 @@
+// Shows, hides and requires the fields of a Formic form as its rules say.
+// Fields are the elements with a data-field attribute. Formic checks the
+// same rules again when the form is submitted (see evaluateRules).
+//
+// Rules can depend on fields from other pages of a multi-step form. saved
+// holds their answers, keyed by field name.
+
+function formicRules(form, rules, saved) {
+  rules = rules || [];
+  saved = saved || {};
+
+  function inputs() {
+    return Array.prototype.filter.call(
+      form.querySelectorAll('input, select, textarea'),
+      function(input) {
+        return !!input.name;
+      }
+    );
+  }
+
+  function values(name) {
+    var named = inputs().filter(function(input) {
+      return input.name === name;
+    });
+    if (!named.length) {
+      return saved[name] || [];
+    }
+    return named.filter(function(input) {
+      if (input.type === 'checkbox' || input.type === 'radio') {
+        return input.checked;
+      }
+      return true;
+    }).map(function(input) {
+      return input.value;
+    });
+  }
+
+  function matches(rule, hidden) {
+    return !hidden[rule.When] && values(rule.When).indexOf(rule.Equals) !== -1;
+  }
+
+  function evaluate() {
+    // Hiding a field can change the outcome of rules that depend on it so
+    // keep going until that settles down
+    var hidden = {};
+    for (var pass = 0; pass <= rules.length; pass++) {
+      var next = {};
+      rules.forEach(function(rule) {
+        var m = matches(rule, hidden);
+        if ((rule.Action === 'show' && !m) || (rule.Action === 'hide' && m)) {
+          next[rule.Field] = true;
+        }
+      });
+      if (JSON.stringify(next) === JSON.stringify(hidden)) {
+        break;
+      }
+      hidden = next;
+    }
+
+    var required = {};
+    rules.forEach(function(rule) {
+      if (rule.Action === 'require' && matches(rule, hidden)) {
+        required[rule.Field] = true;
+      }
+    });
+
+    Array.prototype.forEach.call(
+      form.querySelectorAll('[data-field]'),
+      function(field) {
+        var name = field.getAttribute('data-field');
+        var hide = !!hidden[name];
+        var require = !hide &&
+          (field.getAttribute('data-required') === 'true' || !!required[name]);
+        field.style.display = hide ? 'none' : '';
+        var checkboxes = 0;
+        inputs().forEach(function(input) {
+          if (input.name === name && input.type === 'checkbox') {
+            checkboxes++;
+          }
+        });
+        inputs().forEach(function(input) {
+          if (input.name !== name) {
+            return;
+          }
+          input.disabled = hide;
+          // A group of checkboxes can't require all of them to be checked
+          input.required = require && !(input.type === 'checkbox' && checkboxes > 1);
+        });
+      }
+    );
+  }
+
+  form.addEventListener('change', evaluate);
+  form.addEventListener('input', evaluate);
+  form.addEventListener('reset', function() {
+    // Fields only get their default values back after this event
+    setTimeout(evaluate, 0);
+  });
+  evaluate();
+}